@@ -1,7 +1,14 @@
 package config
 
 import (
+	"crypto/tls"
+	"fmt"
 	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -15,11 +22,224 @@ type Config struct {
 	Routes          map[string]string `yaml:"routes"`            // Host to target URL mappings
 	TrustTarget     map[string]bool   `yaml:"trust_target"`      // Whether to trust invalid target certs
 	NoHTTPSRedirect map[string]bool   `yaml:"no_https_redirect"` // Disable HTTP to HTTPS redirect
+
+	// Server settings
+	ReadHeaderTimeout   int      `yaml:"read_header_timeout"`             // Seconds allowed to read request headers (slowloris defense)
+	SecureByDefault     bool     `yaml:"secure_by_default,omitempty"`     // Only skip target cert checks for hosts explicitly set in trust_target
+	DefaultHostFallback string   `yaml:"default_host_fallback,omitempty"` // Configured host serving unmatched hosts instead of '*'
+	OptionsMode         string   `yaml:"options_mode,omitempty"`          // OPTIONS handling: pass (default), respond (204 + Allow) or reject (405)
+	TLSCurves           []string `yaml:"tls_curves,omitempty"`            // Curves offered by the HTTPS server in preference order (Go defaults if empty)
+	TLSSessionTickets   *bool    `yaml:"tls_session_tickets,omitempty"`   // Enable TLS session ticket resumption (default true)
+	LogOutput           []string `yaml:"log_output,omitempty"`            // Log destinations: file, stdout and/or syslog (default file and stdout)
+	LogTimeFormat       string   `yaml:"log_time_format,omitempty"`       // Log timestamp format: rfc3339, rfc3339nano, iso8601 or a Go layout
+	LogTimezone         string   `yaml:"log_timezone,omitempty"`          // Log timestamp timezone: local (default) or utc
+	LogUpstreamTiming   bool     `yaml:"log_upstream_timing,omitempty"`   // Log a latency breakdown line for every proxied request
+	AccessLog           bool     `yaml:"access_log,omitempty"`            // Write combined-format access lines to logs/access-YYYY-MM-DD.log
+	MaxInFlight         int      `yaml:"max_in_flight,omitempty"`         // Concurrent proxied requests before new ones get 503 (0 = unlimited)
+	MaxConnections      int      `yaml:"max_connections,omitempty"`       // Open client connections across both listeners, further ones wait (0 = unlimited)
+	IdleTimeout         int      `yaml:"idle_timeout,omitempty"`          // Seconds an idle keep-alive client connection stays open (default 60 with max_connections, else no limit)
+	RejectAbsoluteForm  bool     `yaml:"reject_absolute_form,omitempty"`  // Answer 400 to "GET http://host/path" requests meant for a forward proxy
+	DrainMode           bool     `yaml:"drain_mode,omitempty"`            // Answer every proxied request with 503 (maintenance), toggled by editing the config
+	DevMode             bool     `yaml:"dev_mode,omitempty"`              // Local development: trust loopback target certs and never redirect to HTTPS
+	LandingTemplate     string   `yaml:"landing_template,omitempty"`      // html/template file for the built-in web server's landing page
+	ChaosEnabled        bool     `yaml:"chaos_enabled,omitempty"`         // Allow inject_delay (resilience testing only, never in production)
+	RequireSNIMatch     bool     `yaml:"require_sni_match,omitempty"`     // Answer 421 to HTTPS requests whose Host differs from the TLS SNI
+	ACMEWebroot         string   `yaml:"acme_webroot,omitempty"`          // Serve /.well-known/acme-challenge/ from this webroot for external ACME clients
+	DebugHeaders        bool     `yaml:"debug_headers,omitempty"`         // Add X-Proxy-Route-Match, X-Proxy-Upstream and X-Proxy-Duration-Ms (staging only)
+	CertRenewDays       int      `yaml:"cert_renew_days,omitempty"`       // Regenerate the self-signed certificate this many days before it expires (default 30)
+	CertKeyType         string   `yaml:"cert_key_type,omitempty"`         // Key of generated certificates: rsa (default) or ecdsa
+	CertKeyBits         int      `yaml:"cert_key_bits,omitempty"`         // RSA bits (2048, 3072, 4096) or ECDSA curve size (256, 384)
+
+	// External route source merged over routes (default: this file)
+	RouteSource *RouteSource `yaml:"route_source,omitempty"`
+
+	// Paths answered by the proxy for every host instead of being proxied
+	LocalPaths []LocalPath `yaml:"local_paths,omitempty"`
+
+	// Routes selected by request header, keyed by host and checked before routes
+	HeaderRoutes map[string][]HeaderRoute `yaml:"header_routes,omitempty"`
+
+	// Certificates chosen by the TLS server name instead of cert_file, keyed by host ("*.example.com" allowed)
+	CertMap map[string]CertPair `yaml:"cert_map,omitempty"`
+
+	// Per-route settings, keyed by host with '*' as the fallback
+	UpstreamProxy        map[string]string   `yaml:"upstream_proxy,omitempty"`         // HTTP or SOCKS5 proxy used to reach the target
+	AnswerExpectContinue map[string]bool     `yaml:"answer_expect_continue,omitempty"` // Reply "100 Continue" at the proxy instead of the target
+	UpstreamH2C          map[string]bool     `yaml:"upstream_h2c,omitempty"`           // Use HTTP/2 cleartext to http:// targets
+	DisableKeepAlive     map[string]bool     `yaml:"disable_keepalive,omitempty"`      // Use a new upstream connection for every request
+	DefaultContentType   map[string]string   `yaml:"default_content_type,omitempty"`   // Content-Type for upstream responses without one
+	MirrorTo             map[string]string   `yaml:"mirror_to,omitempty"`              // Shadow target receiving copies of requests
+	MirrorPercent        map[string]int      `yaml:"mirror_percent,omitempty"`         // Percentage of requests mirrored (default 100)
+	TrailingSlash        map[string]string   `yaml:"trailing_slash,omitempty"`         // Trailing slash handling: keep (default), add or remove
+	GRPC                 map[string]bool     `yaml:"grpc,omitempty"`                   // gRPC target: HTTP/2 end to end with trailers
+	MaxResponseBody      map[string]int      `yaml:"max_response_body,omitempty"`      // Largest upstream response body relayed, in bytes (0 = unlimited)
+	UpstreamClientCert   map[string]string   `yaml:"upstream_client_cert,omitempty"`   // Client certificate for https:// targets requiring mutual TLS
+	UpstreamClientKey    map[string]string   `yaml:"upstream_client_key,omitempty"`    // Key for upstream_client_cert
+	StripPathPrefix      map[string]string   `yaml:"strip_path_prefix,omitempty"`      // Path prefix removed before proxying (e.g., "/app")
+	LogRequestBody       map[string]int      `yaml:"log_request_body,omitempty"`       // Log up to this many bytes of request bodies for debugging (0 = off)
+	UpstreamHostTemplate map[string]string   `yaml:"upstream_host_template,omitempty"` // Upstream Host header with {host} and {subdomain} placeholders
+	RequestTimeout       map[string]int      `yaml:"request_timeout,omitempty"`        // Seconds the target may take to send response headers (0 = no limit)
+	TimeoutStatus        map[string]int      `yaml:"timeout_status,omitempty"`         // Status sent when request_timeout fires (default 504, e.g. 408)
+	TimeoutMessage       map[string]string   `yaml:"timeout_message,omitempty"`        // Message sent when request_timeout fires
+	PreserveRawPath      map[string]bool     `yaml:"preserve_raw_path,omitempty"`      // Forward the request path exactly as encoded by the client
+	AccessLogSample      map[string]int      `yaml:"access_log_sample,omitempty"`      // Write 1 in N access lines; errors and slow requests are always written
+	InjectDelay          map[string]string   `yaml:"inject_delay,omitempty"`           // Delay before proxying ("500ms" or "100ms-2s"), needs chaos_enabled
+	RetryOnStatus        map[string][]int    `yaml:"retry_on_status,omitempty"`        // Target statuses retried for idempotent requests (e.g., [502, 503])
+	RetryCount           map[string]int      `yaml:"retry_count,omitempty"`            // Retries for retry_on_status (default 1)
+	UpstreamPin          map[string][]string `yaml:"upstream_pin,omitempty"`           // Base64 SHA-256 hashes of accepted target public keys (SPKI)
+	WebSocketTimeout     map[string]int      `yaml:"websocket_timeout,omitempty"`      // Seconds a target may take to answer a WebSocket handshake (default 10)
+	BufferResponse       map[string]bool     `yaml:"buffer_response,omitempty"`        // Read responses up to 1 MiB into memory so slow clients don't hold upstream connections
+	MaxHeaderValue       map[string]int      `yaml:"max_header_value,omitempty"`       // Longest single request header value in bytes, longer ones get 431 (0 = no limit)
+	StreamBuffer         map[string]int      `yaml:"stream_buffer,omitempty"`          // Bytes of a streamed response read ahead of a slow client (default 32768)
+	DuplicateHeaders     map[string]string   `yaml:"duplicate_headers,omitempty"`      // Repeated single-valued response headers: keep (default), first, last or reject
+	RestrictRedirects    map[string]bool     `yaml:"restrict_redirects,omitempty"`     // Only relay redirects to the request's host or redirect_allow
+	RedirectAllow        map[string][]string `yaml:"redirect_allow,omitempty"`         // Extra redirect hosts for restrict_redirects ("*.example.com" allowed)
+	ForwardedPort        map[string]bool     `yaml:"forwarded_port,omitempty"`         // Send the proxy's listener port as X-Forwarded-Port
+	ClientPortHeader     map[string]string   `yaml:"client_port_header,omitempty"`     // Header carrying the client's source port (e.g., X-Client-Port)
+	UpstreamKeepAlive    map[string]int      `yaml:"upstream_keepalive,omitempty"`     // Seconds between TCP keep-alive probes to the target (default 30, -1 = off)
+	UpstreamIdleTimeout  map[string]int      `yaml:"upstream_idle_timeout,omitempty"`  // Seconds a pooled target connection may sit idle (default 90)
+	ForwardedHeaders     map[string]string   `yaml:"forwarded_headers,omitempty"`      // X-Forwarded-* headers: add (default), preserve or strip
+}
+
+// HeaderRoute sends requests carrying a matching header to a different target
+type HeaderRoute struct {
+	Header string `yaml:"header"` // Request header to inspect (e.g., "Accept")
+	Value  string `yaml:"value"`  // Case-insensitive substring to look for; empty only requires the header
+	Target string `yaml:"target"` // Target URL for matching requests
+}
+
+// LocalPath reserves a path (and everything below it) for a response from the proxy itself
+type LocalPath struct {
+	Path      string `yaml:"path"`                // Request path, e.g. "/server-status"
+	Status    int    `yaml:"status"`              // Response status (default 404)
+	Body      string `yaml:"body"`                // Response body (default the status text)
+	Readiness bool   `yaml:"readiness,omitempty"` // Answer 503 instead while drain_mode is on (load balancer readiness check)
+}
+
+// CertPair is a certificate and its key for the hosts of cert_map
+type CertPair struct {
+	CertFile string `yaml:"cert_file"` // Path to the certificate
+	KeyFile  string `yaml:"key_file"`  // Path to its key
+}
+
+// CertFiles lists every certificate and key file in use: cert_file, key_file and those of cert_map
+func (c *Config) CertFiles() []string {
+	files := []string{c.CertFile, c.KeyFile}
+	for _, pair := range c.CertMap {
+		files = append(files, pair.CertFile, pair.KeyFile)
+	}
+	slices.Sort(files)
+	return slices.Compact(files)
+}
+
+// DefaultReadHeaderTimeout is used when read_header_timeout is unset or not positive
+const DefaultReadHeaderTimeout = 5
+
+// HasGRPCRoutes reports whether any host is configured as a gRPC route
+func (c *Config) HasGRPCRoutes() bool {
+	for _, enabled := range c.GRPC {
+		if enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultIdleTimeout closes idle client connections when max_connections is set but idle_timeout isn't,
+// so idle keep-alive clients can't hold every slot
+const DefaultIdleTimeout = 60 * time.Second
+
+// IdleTimeoutDuration returns how long idle keep-alive client connections stay open, 0 for no limit
+func (c *Config) IdleTimeoutDuration() time.Duration {
+	if c.IdleTimeout > 0 {
+		return time.Duration(c.IdleTimeout) * time.Second
+	}
+	if c.MaxConnections > 0 {
+		return DefaultIdleTimeout
+	}
+	return 0
+}
+
+// ReadHeaderTimeoutDuration returns the configured header read timeout as a duration
+func (c *Config) ReadHeaderTimeoutDuration() time.Duration {
+	if c.ReadHeaderTimeout <= 0 {
+		return DefaultReadHeaderTimeout * time.Second
+	}
+	return time.Duration(c.ReadHeaderTimeout) * time.Second
+}
+
+// DefaultCertRenewDays is used when cert_renew_days is unset or not positive
+const DefaultCertRenewDays = 30
+
+// CertRenewWindow returns how long before expiry the self-signed certificate is regenerated
+func (c *Config) CertRenewWindow() time.Duration {
+	days := c.CertRenewDays
+	if days <= 0 {
+		days = DefaultCertRenewDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// tlsCurves maps accepted tls_curves names to curve IDs
+var tlsCurves = map[string]tls.CurveID{
+	"x25519":         tls.X25519,
+	"x25519mlkem768": tls.X25519MLKEM768,
+	"p256":           tls.CurveP256,
+	"p-256":          tls.CurveP256,
+	"p384":           tls.CurveP384,
+	"p-384":          tls.CurveP384,
+	"p521":           tls.CurveP521,
+	"p-521":          tls.CurveP521,
+}
+
+// CurvePreferences converts tls_curves to curve IDs, rejecting unsupported names
+func (c *Config) CurvePreferences() ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range c.TLSCurves {
+		curve, ok := tlsCurves[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported tls_curves entry %q", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+// SessionTicketsEnabled reports whether TLS session tickets are enabled
+func (c *Config) SessionTicketsEnabled() bool {
+	return c.TLSSessionTickets == nil || *c.TLSSessionTickets
+}
+
+// GenerateDefaults controls whether LoadConfig writes a default config when the file is missing;
+// turned off by -no-generate so deployments without their config fail instead of starting with examples
+var GenerateDefaults = true
+
+// normalizeHosts lowercases the host keys of routes and every per-route map so they
+// match the lowercased request host; a trailing dot is dropped as well
+func (c *Config) normalizeHosts() {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.Map || field.Type().Key().Kind() != reflect.String || field.IsNil() {
+			continue
+		}
+		normalized := reflect.MakeMapWithSize(field.Type(), field.Len())
+		iter := field.MapRange()
+		for iter.Next() {
+			host := strings.TrimSuffix(strings.ToLower(iter.Key().String()), ".")
+			normalized.SetMapIndex(reflect.ValueOf(host), iter.Value())
+		}
+		field.Set(normalized)
+	}
+	c.DefaultHostFallback = strings.TrimSuffix(strings.ToLower(c.DefaultHostFallback), ".")
 }
 
 // LoadConfig loads the config from file or creates a default one
 func LoadConfig(configPath string) (*Config, error) {
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		if !GenerateDefaults {
+			return nil, fmt.Errorf("config file %s not found and generating defaults is disabled", configPath)
+		}
 		// Create default configuration
 		defaultConfig := &Config{
 			ListenHTTP:  ":80",
@@ -41,6 +261,7 @@ func LoadConfig(configPath string) (*Config, error) {
 				"main.example.com": false,
 				"gg.example.com":   true, // no automatic redirect to HTTPS from HTTP
 			},
+			ReadHeaderTimeout: DefaultReadHeaderTimeout,
 		}
 		data, err := yaml.Marshal(defaultConfig)
 		if err != nil {
@@ -61,5 +282,14 @@ func LoadConfig(configPath string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return nil, err
 	}
+	if _, err := config.CurvePreferences(); err != nil {
+		return nil, err
+	}
+	for _, lp := range config.LocalPaths {
+		if path.Clean("/"+lp.Path) == "/" {
+			return nil, fmt.Errorf("local_paths entry %q would answer every request, use a path below /", lp.Path)
+		}
+	}
+	config.normalizeHosts()
 	return &config, nil
 }
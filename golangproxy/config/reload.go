@@ -0,0 +1,34 @@
+package config
+
+// Reloader runs config reloads one at a time in a single worker. Requests arriving while a
+// reload is pending are merged, and since the file is read when the reload runs the latest
+// change always wins
+type Reloader struct {
+	pending chan struct{}
+	reload  func()
+}
+
+// NewReloader creates a Reloader calling reload; start its worker with Run
+func NewReloader(reload func()) *Reloader {
+	return &Reloader{pending: make(chan struct{}, 1), reload: reload}
+}
+
+// Request queues a reload unless one is already pending
+func (r *Reloader) Request() {
+	select {
+	case r.pending <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs queued reloads until Close
+func (r *Reloader) Run() {
+	for range r.pending {
+		r.reload()
+	}
+}
+
+// Close stops Run once the pending reload, if any, is done; Request must not be called after
+func (r *Reloader) Close() {
+	close(r.pending)
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golangproxy/logger"
+)
+
+// RouteSource selects where routes come from in addition to the config file
+type RouteSource struct {
+	Type    string `yaml:"type"`    // "file" (default) or "consul"
+	Address string `yaml:"address"` // Consul HTTP address (e.g., "http://127.0.0.1:8500")
+	Prefix  string `yaml:"prefix"`  // KV prefix holding one key per host with the target URL as value
+}
+
+// RouteProvider supplies host to target routes and signals when they change
+type RouteProvider interface {
+	LoadRoutes() (map[string]string, error) // Current host to target URL mappings
+	Changes() <-chan struct{}               // Receives a value whenever routes may have changed
+}
+
+// NewRouteProvider creates the provider configured in route_source, defaulting to the config file
+func NewRouteProvider(cfg *Config, configPath string) (RouteProvider, error) {
+	if cfg.RouteSource == nil {
+		return &FileProvider{Path: configPath}, nil
+	}
+	switch strings.ToLower(cfg.RouteSource.Type) {
+	case "", "file":
+		return &FileProvider{Path: configPath}, nil
+	case "consul":
+		return NewConsulProvider(cfg.RouteSource.Address, cfg.RouteSource.Prefix), nil
+	}
+	return nil, fmt.Errorf("unknown route_source type %q", cfg.RouteSource.Type)
+}
+
+// FileProvider reads routes from the YAML config file; file changes are picked up by the config watcher
+type FileProvider struct {
+	Path string
+}
+
+// LoadRoutes returns the routes section of the config file
+func (p *FileProvider) LoadRoutes() (map[string]string, error) {
+	cfg, err := LoadConfig(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Routes, nil
+}
+
+// Changes returns nil, the config file watcher already triggers reloads
+func (p *FileProvider) Changes() <-chan struct{} {
+	return nil
+}
+
+// ConsulProvider reads routes from a Consul KV prefix and watches it with blocking queries
+type ConsulProvider struct {
+	address string
+	prefix  string
+	client  *http.Client
+	changes chan struct{}
+
+	mu     sync.Mutex
+	routes map[string]string
+	index  string
+}
+
+// NewConsulProvider starts watching the KV prefix at the given Consul address
+func NewConsulProvider(address, prefix string) *ConsulProvider {
+	p := &ConsulProvider{
+		address: strings.TrimRight(address, "/"),
+		prefix:  strings.Trim(prefix, "/") + "/",
+		client:  &http.Client{Timeout: 6 * time.Minute}, // longer than the blocking query wait
+		changes: make(chan struct{}, 1),
+	}
+	go p.watch()
+	return p
+}
+
+// LoadRoutes returns the routes last read from Consul, querying it if nothing was read yet
+func (p *ConsulProvider) LoadRoutes() (map[string]string, error) {
+	p.mu.Lock()
+	routes := p.routes
+	p.mu.Unlock()
+	if routes != nil {
+		return routes, nil
+	}
+	routes, _, err := p.fetch("")
+	return routes, err
+}
+
+// Changes receives a value after the KV prefix changed
+func (p *ConsulProvider) Changes() <-chan struct{} {
+	return p.changes
+}
+
+// watch long-polls the KV prefix and signals Changes whenever the Consul index moves
+func (p *ConsulProvider) watch() {
+	for {
+		p.mu.Lock()
+		index := p.index
+		p.mu.Unlock()
+		routes, newIndex, err := p.fetch(index)
+		if err != nil {
+			logger.Logger.Printf("Error watching consul routes at %s: %v", p.address, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		p.mu.Lock()
+		changed := newIndex != p.index
+		p.routes, p.index = routes, newIndex
+		p.mu.Unlock()
+		if changed && index != "" {
+			select {
+			case p.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// fetch reads all keys under the prefix, blocking until the index differs from the given one
+func (p *ConsulProvider) fetch(index string) (map[string]string, string, error) {
+	url := fmt.Sprintf("%s/v1/kv/%s?recurse=true", p.address, p.prefix)
+	if index != "" {
+		url += "&wait=5m&index=" + index
+	}
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	routes := map[string]string{}
+	newIndex := resp.Header.Get("X-Consul-Index")
+	if resp.StatusCode == http.StatusNotFound {
+		return routes, newIndex, nil // No keys under the prefix yet
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("consul returned %s", resp.Status)
+	}
+	var entries []struct {
+		Key   string
+		Value string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, "", err
+	}
+	for _, entry := range entries {
+		host := strings.TrimPrefix(entry.Key, p.prefix)
+		target, err := base64.StdEncoding.DecodeString(entry.Value)
+		if host == "" || err != nil {
+			continue
+		}
+		routes[host] = strings.TrimSpace(string(target))
+	}
+	return routes, newIndex, nil
+}
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"golangproxy/logger"
+)
+
+// PollInterval is how often files that fsnotify couldn't watch are checked for changes
+var PollInterval = 2 * time.Second
+
+// Watcher reports writes to the config and certificate files. Files are watched with fsnotify;
+// when that fails (e.g., fs.inotify.max_user_watches is exhausted) or a file is deleted they are
+// polled instead, so the proxy keeps running and still picks up changes
+type Watcher struct {
+	Events chan string // Paths of files that were written, deleted or recreated
+
+	watcher *fsnotify.Watcher // nil when no fsnotify watcher could be created
+	mu      sync.Mutex
+	polled  map[string]fileStamp // Polled files and what they looked like when last checked
+	done    chan struct{}
+	once    sync.Once
+}
+
+// fileStamp identifies a version of a polled file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewWatcher creates a Watcher; if fsnotify is unavailable every file added is polled
+func NewWatcher() *Watcher {
+	w := &Watcher{
+		Events: make(chan string, 16),
+		polled: make(map[string]fileStamp),
+		done:   make(chan struct{}),
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Logger.Printf("Error creating file watcher (%s), polling files every %s instead", describeWatchError(err), PollInterval)
+	} else {
+		w.watcher = watcher
+		go w.forward()
+	}
+	go w.poll()
+	return w
+}
+
+// Add watches path, falling back to polling when fsnotify can't watch it
+func (w *Watcher) Add(path string) {
+	if w.watcher != nil {
+		err := w.watcher.Add(path)
+		if err == nil {
+			return
+		}
+		logger.Logger.Printf("Error watching %s (%s), polling it every %s instead", path, describeWatchError(err), PollInterval)
+	}
+	w.mu.Lock()
+	w.polled[path] = statFile(path)
+	w.mu.Unlock()
+}
+
+// Remove stops watching or polling path
+func (w *Watcher) Remove(path string) {
+	if w.watcher != nil {
+		w.watcher.Remove(path)
+	}
+	w.mu.Lock()
+	delete(w.polled, path)
+	w.mu.Unlock()
+}
+
+// Polling reports whether path is polled rather than watched with fsnotify
+func (w *Watcher) Polling(path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.polled[path]
+	return ok
+}
+
+// Close stops watching and polling
+func (w *Watcher) Close() {
+	w.once.Do(func() {
+		close(w.done)
+		if w.watcher != nil {
+			w.watcher.Close()
+		}
+	})
+}
+
+// forward passes fsnotify write events on to Events
+func (w *Watcher) forward() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Write == fsnotify.Write {
+				w.send(event.Name)
+			}
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// The watch went away with the file (deleted, or replaced by an editor's atomic save);
+				// poll until it is back so the change isn't missed and the watch can be set up again
+				w.mu.Lock()
+				w.polled[event.Name] = fileStamp{}
+				w.mu.Unlock()
+				w.send(event.Name)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Logger.Println("Watcher error:", err)
+		}
+	}
+}
+
+// poll checks the polled files for changes every PollInterval
+func (w *Watcher) poll() {
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		var changed []string
+		w.mu.Lock()
+		for path, stamp := range w.polled {
+			current := statFile(path)
+			if current == stamp {
+				continue
+			}
+			w.polled[path] = current
+			changed = append(changed, path)
+			if current != (fileStamp{}) && w.watcher != nil && w.watcher.Add(path) == nil {
+				logger.Logger.Printf("Watching %s again", path)
+				delete(w.polled, path)
+			}
+		}
+		w.mu.Unlock()
+		for _, path := range changed {
+			w.send(path)
+		}
+	}
+}
+
+// send delivers a change unless the watcher was closed
+func (w *Watcher) send(path string) {
+	select {
+	case w.Events <- path:
+	case <-w.done:
+	}
+}
+
+// statFile returns the current stamp of path, the zero stamp if it doesn't exist
+func statFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// describeWatchError names the inotify limit behind err when there is one
+func describeWatchError(err error) string {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return "inotify watch limit reached, raise fs.inotify.max_user_watches"
+	case errors.Is(err, syscall.EMFILE):
+		return "inotify instance limit reached, raise fs.inotify.max_user_instances"
+	}
+	return err.Error()
+}
@@ -0,0 +1,33 @@
+package hostmatch
+
+import (
+	"net"
+	"strings"
+)
+
+// Normalize lowercases a host and drops a trailing dot and the default HTTP/HTTPS port
+func Normalize(host string) string {
+	host = strings.ToLower(host)
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(host, ".")
+	}
+	hostname = strings.TrimSuffix(hostname, ".")
+	if port == "80" || port == "443" {
+		return hostname
+	}
+	return net.JoinHostPort(hostname, port)
+}
+
+// Wildcard finds the wildcard key of m covering hostname, most specific first:
+// a.b.example.com tries *.b.example.com, then *.example.com
+func Wildcard[T any](m map[string]T, hostname string) (T, bool) {
+	for rest := hostname; strings.Contains(rest, "."); {
+		_, rest, _ = strings.Cut(rest, ".")
+		if value, ok := m["*."+rest]; ok {
+			return value, true
+		}
+	}
+	var zero T
+	return zero, false
+}
@@ -0,0 +1,81 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AccessLogger receives one combined-format line per proxied request; it discards
+// everything until EnableAccessLog is called
+var AccessLogger = log.New(io.Discard, "", 0)
+
+// EnableAccessLog starts writing access lines to logs/access-YYYY-MM-DD.log, switching files daily
+func EnableAccessLog() error {
+	w := &dailyWriter{dir: "logs", prefix: "access"}
+	if err := w.rotate(time.Now()); err != nil {
+		return err
+	}
+	AccessLogger.SetOutput(w)
+	return nil
+}
+
+// DisableAccessLog stops writing access lines
+func DisableAccessLog() {
+	if w, ok := AccessLogger.Writer().(*dailyWriter); ok {
+		w.Close()
+	}
+	AccessLogger.SetOutput(io.Discard)
+}
+
+// dailyWriter appends to <dir>/<prefix>-YYYY-MM-DD.log and opens a new file when the date changes
+type dailyWriter struct {
+	mu     sync.Mutex
+	dir    string
+	prefix string
+	day    string
+	file   *os.File
+}
+
+func (w *dailyWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if now := time.Now(); now.Format("2006-01-02") != w.day {
+		if err := w.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	return w.file.Write(p)
+}
+
+// rotate opens the file for the given day, closing the previous one
+func (w *dailyWriter) rotate(now time.Time) error {
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return fmt.Errorf("error creating logs directory: %v", err)
+	}
+	day := now.Format("2006-01-02")
+	file, err := os.OpenFile(filepath.Join(w.dir, fmt.Sprintf("%s-%s.log", w.prefix, day)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening %s log file: %v", w.prefix, err)
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = file
+	w.day = day
+	return nil
+}
+
+// Close closes the current file
+func (w *dailyWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
@@ -1,30 +1,193 @@
 package logger
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-// Logger is the global logger instance
-var Logger *log.Logger
+// Logger is the global logger instance, writing to stdout until InitLogger runs
+var Logger = log.New(os.Stdout, "", log.LstdFlags)
+
+// Timestamp settings applied by SetTimeFormat
+var (
+	output     io.Writer = os.Stdout // Combined log destinations chosen by Configure
+	timeLayout string                // Go time layout; empty keeps the standard log timestamp
+	timeUTC    bool                  // Print timestamps in UTC instead of local time
+)
+
+// closers are the files and connections Configure opened for output, closed once replaced
+var closers []io.Closer
+
+// timeFormats maps named log_time_format values to Go time layouts
+var timeFormats = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"iso8601":     "2006-01-02T15:04:05.000Z07:00",
+}
+
+// Log output destinations accepted by Configure
+const (
+	OutputFile   = "file"   // logs/proxy.log
+	OutputStdout = "stdout" // Terminal
+	OutputSyslog = "syslog" // System log (journald via syslog on Linux)
+)
 
 // InitLogger initializes logging to file and stdout
 func InitLogger() {
+	if err := Configure([]string{OutputFile, OutputStdout}); err != nil {
+		log.Printf("Error initializing logger: %v", err)
+	}
+}
+
+// Configure points the logger at the given outputs; an empty list keeps the default file and stdout.
+// If the log file can't be written (e.g., read-only filesystem) logging continues on stdout only.
+// It can be called again on config reloads: on error the current outputs stay in place, otherwise
+// the ones they replace are closed
+func Configure(outputs []string) error {
+	if len(outputs) == 0 {
+		outputs = []string{OutputFile, OutputStdout}
+	}
+	var writers []io.Writer
+	var opened []io.Closer
+	var warnings []string
+	for _, output := range outputs {
+		switch strings.ToLower(strings.TrimSpace(output)) {
+		case OutputFile:
+			logFile, err := openLogFile()
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("WARNING: file logging disabled (%v), logging to stdout only", err))
+				writers = append(writers, os.Stdout)
+				continue
+			}
+			writers = append(writers, logFile)
+			opened = append(opened, logFile)
+		case OutputStdout:
+			writers = append(writers, os.Stdout)
+		case OutputSyslog:
+			syslogWriter, err := newSyslogWriter()
+			if err != nil {
+				// Syslog is unavailable (e.g., on Windows), keep the messages visible on stdout
+				warnings = append(warnings, fmt.Sprintf("WARNING: syslog output unavailable (%v), logging to stdout instead", err))
+				writers = append(writers, os.Stdout)
+				continue
+			}
+			writers = append(writers, syslogWriter)
+			if c, ok := syslogWriter.(io.Closer); ok {
+				opened = append(opened, c)
+			}
+		default:
+			closeAll(opened)
+			return fmt.Errorf("unknown log output %q", output)
+		}
+	}
+	output = io.MultiWriter(dedupeWriters(writers)...)
+	applyOutput()
+	// Logger.SetOutput waits for writes in progress, nothing uses the replaced outputs anymore
+	closeAll(closers)
+	closers = opened
+	for _, warning := range warnings {
+		Logger.Println(warning)
+	}
+	return nil
+}
+
+// SetTimeFormat sets the log timestamp format ("rfc3339", "rfc3339nano", "iso8601" or a Go
+// time layout; empty keeps the standard format) and timezone ("local" or "utc")
+func SetTimeFormat(format, timezone string) error {
+	layout := format
+	if named, ok := timeFormats[strings.ToLower(format)]; ok {
+		layout = named
+	}
+	switch strings.ToLower(timezone) {
+	case "", "local":
+		timeUTC = false
+	case "utc":
+		timeUTC = true
+	default:
+		return fmt.Errorf("unknown log timezone %q", timezone)
+	}
+	timeLayout = layout
+	applyOutput()
+	return nil
+}
+
+// applyOutput installs the current destinations and timestamp settings on Logger
+func applyOutput() {
+	// Wrap the logger to filter context canceled errors
+	var w io.Writer = &filteredWriter{Writer: output}
+	if timeLayout == "" {
+		flags := log.LstdFlags
+		if timeUTC {
+			flags |= log.LUTC
+		}
+		Logger.SetFlags(flags)
+	} else {
+		// The standard log flags only know a fixed format, so the timestamp is written here
+		Logger.SetFlags(0)
+		w = &timestampWriter{Writer: w, layout: timeLayout, utc: timeUTC}
+	}
+	Logger.SetOutput(w)
+}
+
+// timestampWriter prefixes each log line with a custom formatted timestamp
+type timestampWriter struct {
+	Writer io.Writer
+	layout string
+	utc    bool
+}
+
+func (tw *timestampWriter) Write(p []byte) (int, error) {
+	now := time.Now()
+	if tw.utc {
+		now = now.UTC()
+	}
+	line := append([]byte(now.Format(tw.layout)+" "), p...)
+	if _, err := tw.Writer.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// closeAll closes log outputs that are no longer used
+func closeAll(list []io.Closer) {
+	for _, c := range list {
+		c.Close()
+	}
+}
+
+// openLogFile opens logs/proxy.log for appending, creating the directory if needed
+func openLogFile() (*os.File, error) {
 	if err := os.MkdirAll("logs", 0755); err != nil {
-		log.Fatalf("Error creating logs directory: %v", err)
+		return nil, fmt.Errorf("error creating logs directory: %v", err)
 	}
 	logFile, err := os.OpenFile(filepath.Join("logs", "proxy.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		log.Fatalf("Error opening log file: %v", err)
+		return nil, fmt.Errorf("error opening log file: %v", err)
 	}
-	multiWriter := io.MultiWriter(os.Stdout, logFile)
-	Logger = log.New(multiWriter, "", log.LstdFlags)
-	// Wrap the logger to filter context canceled errors
-	oldOutput := Logger.Writer()
-	Logger.SetOutput(&filteredWriter{Writer: oldOutput})
+	return logFile, nil
+}
+
+// dedupeWriters drops repeated writers so fallbacks don't print lines to stdout twice
+func dedupeWriters(writers []io.Writer) []io.Writer {
+	var unique []io.Writer
+	for _, w := range writers {
+		seen := false
+		for _, u := range unique {
+			if u == w {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			unique = append(unique, w)
+		}
+	}
+	return unique
 }
 
 // filteredWriter wraps an io.Writer to filter out context canceled errors
@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// syslogWriter sends each log line to the system log with a priority derived from its content
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// newSyslogWriter connects to the local syslog daemon (journald listens on the same socket)
+func newSyslogWriter() (io.Writer, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "golangproxy")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (sw *syslogWriter) Write(p []byte) (int, error) {
+	msg := string(p)
+	lower := strings.ToLower(msg)
+	var err error
+	switch {
+	case strings.Contains(lower, "error"):
+		err = sw.w.Err(msg)
+	case strings.Contains(lower, "warning"):
+		err = sw.w.Warning(msg)
+	default:
+		err = sw.w.Info(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (sw *syslogWriter) Close() error {
+	return sw.w.Close()
+}
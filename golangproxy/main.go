@@ -3,17 +3,20 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"flag"
 	"log"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
-
 	"golangproxy/config"
 	"golangproxy/logger"
 	"golangproxy/proxy"
@@ -24,21 +27,29 @@ import (
 // Global variables for dynamic configuration and certificate updates
 var (
 	configPath    = "config.yaml"
-	routesMutex   sync.RWMutex            // Protects routes and defaultRoute
-	certMutex     sync.RWMutex            // Protects currentCert
+	routesMutex   sync.RWMutex            // Protects router
+	reloadMutex   sync.Mutex              // Serializes config and cert reloads, protects currentConfig
+	reloader      *config.Reloader        // Coalesced config reloads, run one at a time
 	currentConfig *config.Config          // Current configuration
-	currentCert   *tls.Certificate        // Current SSL certificate
-	routes        map[string]*proxy.Route // Host-specific routes
-	defaultRoute  *proxy.Route            // Wildcard route
-	watcher       *fsnotify.Watcher       // File watcher instance
+	certs         = ssl.NewCertStore()    // Default and cert_map certificates
+	router        *proxy.Router           // Host-specific and wildcard routes
+	routeProvider config.RouteProvider    // Source of routes merged over the config file (set at startup)
+	admission     = &proxy.Admission{}    // Proxy-wide in-flight request ceiling
+	connLimit     = proxy.NewConnLimit(0) // Open connection cap across the HTTP and HTTPS listeners
+	watcher       *config.Watcher         // File watcher instance
 )
 
 // main initializes and runs the reverse proxy application
 func main() {
-	// Initialize logging to file and terminal
-	logger.InitLogger()
 	log := logger.Logger
 
+	// -no-generate (or GOLANGPROXY_NO_GENERATE=true) fails on a missing config or certificate
+	// instead of creating example defaults
+	noGenerateEnv, _ := strconv.ParseBool(os.Getenv("GOLANGPROXY_NO_GENERATE"))
+	noGenerate := flag.Bool("no-generate", noGenerateEnv, "fail if config.yaml or the certificate files are missing instead of generating defaults")
+	flag.Parse()
+	config.GenerateDefaults = !*noGenerate
+
 	// Load initial configuration
 	var err error
 	currentConfig, err = config.LoadConfig(configPath)
@@ -46,34 +57,57 @@ func main() {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
-	// Ensure SSL certificate and key files exist
-	err = ssl.EnsureCertFiles(currentConfig.CertFile, currentConfig.KeyFile)
-	if err != nil {
-		log.Fatalf("Error ensuring cert files: %v", err)
+	// Initialize logging to the configured outputs (file and terminal by default)
+	if err := logger.Configure(currentConfig.LogOutput); err != nil {
+		log.Fatalf("Error initializing logger: %v", err)
 	}
+	if err := logger.SetTimeFormat(currentConfig.LogTimeFormat, currentConfig.LogTimezone); err != nil {
+		log.Fatalf("Error setting log time format: %v", err)
+	}
+	updateAccessLog(log, false, currentConfig.AccessLog)
 
-	// Load initial SSL certificate
-	cert, err := tls.LoadX509KeyPair(currentConfig.CertFile, currentConfig.KeyFile)
+	// Set up the route source; external sources are merged over the file routes
+	routeProvider, err = config.NewRouteProvider(currentConfig, configPath)
 	if err != nil {
+		log.Fatalf("Error setting up route source: %v", err)
+	}
+	mergeProviderRoutes(log, currentConfig)
+
+	// Ensure SSL certificate and key files exist; with -no-generate loading them below fails instead
+	ssl.SetKeyType(currentConfig.CertKeyType, currentConfig.CertKeyBits)
+	if config.GenerateDefaults {
+		// A generated certificate covers the configured route hosts
+		err = ssl.EnsureCertFiles(currentConfig.CertFile, currentConfig.KeyFile, slices.Collect(maps.Keys(currentConfig.Routes))...)
+		if err != nil {
+			log.Fatalf("Error ensuring cert files: %v", err)
+		}
+	}
+
+	// Load initial SSL certificates
+	if err := certs.Load(currentConfig.CertFile, currentConfig.KeyFile, currentConfig.CertMap); err != nil {
 		log.Fatalf("Error loading cert: %v", err)
 	}
-	certMutex.Lock()
-	currentCert = &cert
-	certMutex.Unlock()
+
+	// TLS curve names were validated when the config was loaded
+	curves, _ := currentConfig.CurvePreferences()
 
 	// Initialize proxy routes from config
 	initializeRoutes(log)
+	admission.SetLimit(currentConfig.MaxInFlight)
+	admission.SetDraining(currentConfig.DrainMode)
+	connLimit.SetLimit(currentConfig.MaxConnections)
+	updateLanding()
 
 	// Start the simple web server in a goroutine
-	go server.StartServer()
+	go server.StartServer(currentConfig.ReadHeaderTimeoutDuration())
 
 	// Configure HTTP server
 	httpServer := &http.Server{
-		Addr: currentConfig.ListenHTTP,
+		Addr:              currentConfig.ListenHTTP,
+		ReadHeaderTimeout: currentConfig.ReadHeaderTimeoutDuration(),
+		IdleTimeout:       currentConfig.IdleTimeoutDuration(),
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			routesMutex.RLock()
-			route := getRoute(r.Host)
-			routesMutex.RUnlock()
+			route := getRoute(w, r)
 			if strings.HasPrefix(route.Target, "https://") && !route.NoHTTPSRedirect {
 				httpsURL := "https://" + r.Host + r.URL.Path
 				if r.URL.RawQuery != "" {
@@ -82,90 +116,101 @@ func main() {
 				http.Redirect(w, r, httpsURL, http.StatusMovedPermanently)
 				return
 			}
-			route.Handler.ServeHTTP(w, r) // Use Handler instead of Proxy
+			serveRoute(w, r, route)
 		}),
 		ErrorLog: logger.Logger, // Add this to filter server-level errors (from previous fix)
 	}
 
+	if currentConfig.HasGRPCRoutes() {
+		// Accept HTTP/2 cleartext (prior knowledge) so plaintext gRPC clients keep HTTP/2 end to end;
+		// the server's protocols can't change while it runs, reloads only warn that a restart is needed
+		httpServer.Protocols = new(http.Protocols)
+		httpServer.Protocols.SetHTTP1(true)
+		httpServer.Protocols.SetUnencryptedHTTP2(true)
+	}
+
 	// Configure HTTPS server
 	httpsServer := &http.Server{
-		Addr: currentConfig.ListenHTTPS,
+		Addr:              currentConfig.ListenHTTPS,
+		ReadHeaderTimeout: currentConfig.ReadHeaderTimeoutDuration(),
+		IdleTimeout:       currentConfig.IdleTimeoutDuration(),
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			routesMutex.RLock()
-			route := getRoute(r.Host)
-			routesMutex.RUnlock()
-			route.Handler.ServeHTTP(w, r) // Use Handler instead of Proxy
+			serveRoute(w, r, getRoute(w, r))
 		}),
 		TLSConfig: &tls.Config{
-			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-				certMutex.RLock()
-				defer certMutex.RUnlock()
-				return currentCert, nil
-			},
+			CurvePreferences:       curves,
+			SessionTicketsDisabled: !currentConfig.SessionTicketsEnabled(),
+			GetCertificate:         certs.GetCertificate,
 		},
-		ErrorLog: logger.Logger, // Add this to filter server-level errors (from previous fix)
 	}
+	// Failed TLS handshakes are logged with the server name and versions the client offered
+	ssl.NewHandshakeLog().Attach(httpsServer)
 
 	// Start servers in goroutines
 	go func() {
 		log.Println("Starting HTTP server on", currentConfig.ListenHTTP)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		listener, err := listen(currentConfig.ListenHTTP)
+		if err != nil {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
 
 	go func() {
 		log.Println("Starting HTTPS server on", currentConfig.ListenHTTPS)
-		if err := httpsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		listener, err := listen(currentConfig.ListenHTTPS)
+		if err != nil {
+			log.Fatalf("HTTPS server error: %v", err)
+		}
+		if err := httpsServer.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTPS server error: %v", err)
 		}
 	}()
 
-	// Initialize file watcher
-	watcher, err = fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatalf("Error creating watcher: %v", err)
-	}
+	// Initialize file watcher, files it can't watch are polled
+	watcher = config.NewWatcher()
 	defer watcher.Close()
 
 	// Watch initial config and cert files
-	err = watcher.Add(configPath)
-	if err != nil {
-		log.Fatalf("Error watching config file: %v", err)
+	watcher.Add(configPath)
+	for _, file := range currentConfig.CertFiles() {
+		watcher.Add(file)
 	}
-	err = watcher.Add(currentConfig.CertFile)
-	if err != nil {
-		log.Println("Error watching cert file:", err)
+
+	// Keep the generated self-signed certificate from expiring
+	if config.GenerateDefaults {
+		go renewSelfSignedCert(log)
 	}
-	err = watcher.Add(currentConfig.KeyFile)
-	if err != nil {
-		log.Println("Error watching key file:", err)
+
+	// Apply config reloads one at a time in a single worker
+	reloader = config.NewReloader(func() { reloadConfig(log) })
+	go reloader.Run()
+
+	// Reload when the external route source reports a change
+	if changes := routeProvider.Changes(); changes != nil {
+		go func() {
+			for range changes {
+				reloader.Request()
+			}
+		}()
 	}
 
 	// Handle file updates in a goroutine
 	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					switch event.Name {
-					case configPath:
-						log.Println("Config file changed, reloading...")
-						reloadConfig(log)
-					case currentConfig.CertFile, currentConfig.KeyFile:
-						log.Println("Cert files changed, reloading cert...")
-						reloadCert(log)
-					}
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Println("Watcher error:", err)
+		for name := range watcher.Events {
+			if name == configPath {
+				log.Println("Config file changed, reloading...")
+				reloader.Request()
+				continue
+			}
+			reloadMutex.Lock()
+			if slices.Contains(currentConfig.CertFiles(), name) {
+				log.Println("Cert files changed, reloading cert...")
+				reloadCert(log)
 			}
+			reloadMutex.Unlock()
 		}
 	}()
 
@@ -185,40 +230,201 @@ func main() {
 	}
 }
 
-// getRoute retrieves the appropriate proxy route for a host
-func getRoute(host string) *proxy.Route {
+// getRoute retrieves the appropriate proxy route for a request, noting how it matched when debug_headers is on
+func getRoute(w http.ResponseWriter, r *http.Request) *proxy.Route {
 	routesMutex.RLock()
 	defer routesMutex.RUnlock()
-	if route, ok := routes[host]; ok {
-		return route
+	route, match := router.MatchKind(r)
+	if router.DebugHeaders {
+		w.Header().Set("X-Proxy-Route-Match", match)
+	}
+	return route
+}
+
+// listen opens a listening socket whose connections count against max_connections
+func listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
 	}
-	return defaultRoute
+	return connLimit.Listener(listener), nil
 }
 
-// initializeRoutes sets up the routes map and default route from the current config
+// serveRoute proxies a request through its route, shedding it when max_in_flight is reached or in drain_mode;
+// routes answered by the proxy itself (local paths, unconfigured hosts) are never shed, readiness paths report draining
+func serveRoute(w http.ResponseWriter, r *http.Request, route *proxy.Route) {
+	admission.ServeRoute(w, r, route)
+}
+
+// initializeRoutes sets up the routes map and default route from the current config,
+// reusing routes whose target and options did not change since the last call
 func initializeRoutes(log *log.Logger) {
-	routesMutex.Lock()
-	defer routesMutex.Unlock()
+	if currentConfig.ChaosEnabled {
+		log.Println("WARNING: chaos_enabled is set, routes with inject_delay are deliberately slowed down")
+	}
+	if currentConfig.DevMode {
+		log.Println("WARNING: dev_mode is enabled, certificates of localhost targets are not verified and HTTP is never redirected to HTTPS. Do not use in production!")
+	}
+	routesMutex.RLock()
+	oldRouter := router
+	routesMutex.RUnlock()
+	oldRoutes := map[string]*proxy.Route{}
+	oldHeaderRoutes := map[string][]proxy.HeaderRoute{}
+	var oldDefault *proxy.Route
+	if oldRouter != nil {
+		oldRoutes = oldRouter.Routes
+		oldHeaderRoutes = oldRouter.HeaderRoutes
+		oldDefault = oldRouter.Default
+	}
 
-	routes = make(map[string]*proxy.Route)
+	rebuilt := 0
+	routes := make(map[string]*proxy.Route)
 	for host, target := range currentConfig.Routes {
 		if host == "*" {
 			continue
 		}
-		trust := getConfigBool(currentConfig.TrustTarget, host)
-		noRedirect := getConfigBool(currentConfig.NoHTTPSRedirect, host)
-		route := proxy.CreateRoute(target, trust)
-		route.NoHTTPSRedirect = noRedirect
+		opts := routeOptions(host)
+		route := proxy.ReuseOrCreate(oldRoutes[host], target, opts)
+		if route != oldRoutes[host] {
+			rebuilt++
+			warnInsecureRoute(log, host, target, opts.TrustInvalidCert)
+		}
 		routes[host] = route
 	}
 	defaultTarget, ok := currentConfig.Routes["*"]
 	if !ok {
 		log.Fatal("Default route '*' not found in config")
 	}
-	defaultTrust := currentConfig.TrustTarget["*"]
-	defaultNoRedirect := currentConfig.NoHTTPSRedirect["*"]
-	defaultRoute = proxy.CreateRoute(defaultTarget, defaultTrust)
-	defaultRoute.NoHTTPSRedirect = defaultNoRedirect
+	defaultOpts := routeOptions("*")
+	var defaultRoute *proxy.Route
+	if defaultTarget == proxy.RejectTarget {
+		// Strict virtual hosting: unmatched hosts get a 421 instead of reaching a catch-all target
+		defaultRoute = proxy.RejectRoute()
+	} else {
+		defaultRoute = proxy.ReuseOrCreate(oldDefault, defaultTarget, defaultOpts)
+		if defaultRoute != oldDefault {
+			rebuilt++
+			warnInsecureRoute(log, "*", defaultTarget, defaultOpts.TrustInvalidCert)
+		}
+	}
+
+	headerRoutes := make(map[string][]proxy.HeaderRoute)
+	for host, conditions := range currentConfig.HeaderRoutes {
+		opts := routeOptions(host)
+		for i, condition := range conditions {
+			var existing *proxy.Route
+			if i < len(oldHeaderRoutes[host]) {
+				existing = oldHeaderRoutes[host][i].Route
+			}
+			route := proxy.ReuseOrCreate(existing, condition.Target, opts)
+			if route != existing {
+				warnInsecureRoute(log, host, condition.Target, opts.TrustInvalidCert)
+			}
+			headerRoutes[host] = append(headerRoutes[host], proxy.HeaderRoute{Header: condition.Header, Value: condition.Value, Route: route})
+		}
+	}
+
+	if oldRouter != nil {
+		log.Printf("Routes reloaded: %d rebuilt, %d unchanged", rebuilt, len(routes)+1-rebuilt)
+	}
+
+	fallbackHost := currentConfig.DefaultHostFallback
+	if fallbackHost != "" {
+		if _, ok := routes[fallbackHost]; !ok {
+			log.Printf("default_host_fallback %s has no route, unmatched hosts will get a 404", fallbackHost)
+		}
+	}
+
+	localPaths := make(map[string]*proxy.Route)
+	for _, lp := range currentConfig.LocalPaths {
+		route := proxy.LocalRoute(lp.Status, lp.Body)
+		route.Readiness = lp.Readiness
+		localPaths[proxy.CleanPath(lp.Path)] = route
+	}
+
+	var acme *proxy.Route
+	if currentConfig.ACMEWebroot != "" {
+		acme = proxy.ACMERoute(currentConfig.ACMEWebroot)
+	}
+
+	routesMutex.Lock()
+	router = &proxy.Router{
+		Routes:       routes,
+		Default:      defaultRoute,
+		FallbackHost: fallbackHost,
+		HeaderRoutes: headerRoutes,
+		LocalPaths:   localPaths,
+		RequireSNI:   currentConfig.RequireSNIMatch,
+		ACME:         acme,
+		DebugHeaders: currentConfig.DebugHeaders,
+		NoAbsolute:   currentConfig.RejectAbsoluteForm,
+	}
+	routesMutex.Unlock()
+}
+
+// routeOptions collects the per-route proxy options for a host from the current config
+func routeOptions(host string) proxy.RouteOptions {
+	return proxy.RouteOptions{
+		TrustInvalidCert:     getTrustTarget(host),
+		NoHTTPSRedirect:      getConfigBool(currentConfig.NoHTTPSRedirect, host) || currentConfig.DevMode,
+		UpstreamProxy:        getConfigString(currentConfig.UpstreamProxy, host),
+		AnswerExpectContinue: getConfigBool(currentConfig.AnswerExpectContinue, host),
+		OptionsMode:          currentConfig.OptionsMode,
+		LogTiming:            currentConfig.LogUpstreamTiming,
+		UpstreamH2C:          getConfigBool(currentConfig.UpstreamH2C, host),
+		DisableKeepAlive:     getConfigBool(currentConfig.DisableKeepAlive, host),
+		AccessLog:            currentConfig.AccessLog,
+		DefaultContentType:   getConfigString(currentConfig.DefaultContentType, host),
+		MirrorTo:             getConfigString(currentConfig.MirrorTo, host),
+		MirrorPercent:        getConfigInt(currentConfig.MirrorPercent, host),
+		TrailingSlash:        getConfigString(currentConfig.TrailingSlash, host),
+		GRPC:                 getConfigBool(currentConfig.GRPC, host),
+		MaxResponseBody:      int64(getConfigInt(currentConfig.MaxResponseBody, host)),
+		UpstreamClientCert:   getConfigString(currentConfig.UpstreamClientCert, host),
+		UpstreamClientKey:    getConfigString(currentConfig.UpstreamClientKey, host),
+		StripPathPrefix:      getConfigString(currentConfig.StripPathPrefix, host),
+		LogRequestBody:       getConfigInt(currentConfig.LogRequestBody, host),
+		UpstreamHostTemplate: getConfigString(currentConfig.UpstreamHostTemplate, host),
+		DevMode:              currentConfig.DevMode,
+		RequestTimeout:       time.Duration(getConfigInt(currentConfig.RequestTimeout, host)) * time.Second,
+		TimeoutStatus:        getConfigInt(currentConfig.TimeoutStatus, host),
+		TimeoutMessage:       getConfigString(currentConfig.TimeoutMessage, host),
+		PreserveRawPath:      getConfigBool(currentConfig.PreserveRawPath, host),
+		AccessLogSample:      getConfigInt(currentConfig.AccessLogSample, host),
+		ChaosEnabled:         currentConfig.ChaosEnabled,
+		InjectDelay:          getConfigString(currentConfig.InjectDelay, host),
+		RetryOnStatus:        getConfigList(currentConfig.RetryOnStatus, host),
+		RetryCount:           getConfigInt(currentConfig.RetryCount, host),
+		UpstreamPins:         getConfigList(currentConfig.UpstreamPin, host),
+		UpgradeTimeout:       time.Duration(getConfigInt(currentConfig.WebSocketTimeout, host)) * time.Second,
+		BufferResponse:       getConfigBool(currentConfig.BufferResponse, host),
+		MaxHeaderValue:       getConfigInt(currentConfig.MaxHeaderValue, host),
+		StreamBuffer:         getConfigInt(currentConfig.StreamBuffer, host),
+		DebugHeaders:         currentConfig.DebugHeaders,
+		DuplicateHeaders:     getConfigString(currentConfig.DuplicateHeaders, host),
+		RestrictRedirects:    getConfigBool(currentConfig.RestrictRedirects, host),
+		RedirectAllow:        getConfigList(currentConfig.RedirectAllow, host),
+		ForwardedPort:        getConfigBool(currentConfig.ForwardedPort, host),
+		ClientPortHeader:     getConfigString(currentConfig.ClientPortHeader, host),
+		UpstreamKeepAlive:    time.Duration(getConfigInt(currentConfig.UpstreamKeepAlive, host)) * time.Second,
+		UpstreamIdleTimeout:  time.Duration(getConfigInt(currentConfig.UpstreamIdleTimeout, host)) * time.Second,
+		ForwardedHeaders:     getConfigString(currentConfig.ForwardedHeaders, host),
+	}
+}
+
+// getTrustTarget resolves trust_target for a host; in secure_by_default mode the '*' value is not inherited
+func getTrustTarget(host string) bool {
+	if currentConfig.SecureByDefault {
+		return currentConfig.TrustTarget[host]
+	}
+	return getConfigBool(currentConfig.TrustTarget, host)
+}
+
+// warnInsecureRoute logs a warning for HTTPS targets whose certificates are not verified
+func warnInsecureRoute(log *log.Logger, host, target string, trust bool) {
+	if trust && strings.HasPrefix(target, "https://") {
+		log.Printf("WARNING: route %s -> %s skips upstream certificate verification (trust_target: true)", host, target)
+	}
 }
 
 // getConfigBool retrieves a boolean config value, falling back to '*' if host-specific value is absent
@@ -229,32 +435,142 @@ func getConfigBool(m map[string]bool, host string) bool {
 	return m["*"]
 }
 
+// getConfigString retrieves a string config value, falling back to '*' if host-specific value is absent
+func getConfigString(m map[string]string, host string) string {
+	if val, ok := m[host]; ok {
+		return val
+	}
+	return m["*"]
+}
+
+// getConfigInt retrieves an integer config value, falling back to '*' if host-specific value is absent
+func getConfigInt(m map[string]int, host string) int {
+	if val, ok := m[host]; ok {
+		return val
+	}
+	return m["*"]
+}
+
+// getConfigList retrieves a list config value, falling back to '*' if host-specific value is absent
+func getConfigList[T any](m map[string][]T, host string) []T {
+	if val, ok := m[host]; ok {
+		return val
+	}
+	return m["*"]
+}
+
 // reloadConfig reloads the configuration and updates routes and certs if necessary
 func reloadConfig(log *log.Logger) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	// A missing file would be replaced with the defaults, keep serving the last good config instead
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		log.Printf("ERROR: %s was deleted, still serving the last loaded config; it is reloaded once the file is back", configPath)
+		return
+	}
 	newConfig, err := config.LoadConfig(configPath)
 	if err != nil {
 		log.Println("Error reloading config:", err)
 		return
 	}
+	mergeProviderRoutes(log, newConfig)
 
 	// Log differences between old and new config
 	log.Println("Config file changed, reloading...")
 	logConfigChanges(log, currentConfig, newConfig)
 
 	// Store old cert file paths before updating config
-	oldCertFile := currentConfig.CertFile
-	oldKeyFile := currentConfig.KeyFile
-	certChanged := newConfig.CertFile != oldCertFile || newConfig.KeyFile != oldKeyFile
+	oldCertFiles := currentConfig.CertFiles()
+	certChanged := newConfig.CertFile != currentConfig.CertFile || newConfig.KeyFile != currentConfig.KeyFile ||
+		!maps.Equal(newConfig.CertMap, currentConfig.CertMap)
 
+	updateAccessLog(log, currentConfig.AccessLog, newConfig.AccessLog)
+	updateLogSettings(log, currentConfig, newConfig)
 	currentConfig = newConfig
 
 	// Update routes
 	initializeRoutes(log)
+	admission.SetLimit(currentConfig.MaxInFlight)
+	admission.SetDraining(currentConfig.DrainMode)
+	connLimit.SetLimit(currentConfig.MaxConnections)
+	ssl.SetKeyType(currentConfig.CertKeyType, currentConfig.CertKeyBits)
+	updateLanding()
 
 	// Update certificates and watcher if paths changed
 	if certChanged {
 		reloadCert(log)
-		updateCertWatchers(log, oldCertFile, oldKeyFile)
+		updateCertWatchers(oldCertFiles)
+	}
+}
+
+// mergeProviderRoutes overlays the routes from the route source on the config file routes;
+// if the source is unreachable the file routes are used as they are
+func mergeProviderRoutes(log *log.Logger, cfg *config.Config) {
+	if !sameRouteSource(currentConfig.RouteSource, cfg.RouteSource) {
+		log.Println("route_source changed, restart to apply")
+	}
+	if _, ok := routeProvider.(*config.FileProvider); ok {
+		return // Its routes are the ones cfg was just loaded with, don't parse the file twice
+	}
+	routes, err := routeProvider.LoadRoutes()
+	if err != nil {
+		log.Println("Error loading routes from route source:", err)
+		return
+	}
+	if cfg.Routes == nil {
+		cfg.Routes = make(map[string]string)
+	}
+	for host, target := range routes {
+		cfg.Routes[strings.ToLower(host)] = target
+	}
+}
+
+// sameRouteSource reports whether two route_source settings are equal
+func sameRouteSource(a, b *config.RouteSource) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// updateLanding passes the landing_template and the configured hostnames to the web server
+func updateLanding() {
+	var hosts []string
+	for host := range currentConfig.Routes {
+		if host != "*" {
+			hosts = append(hosts, host)
+		}
+	}
+	server.SetLanding(currentConfig.LandingTemplate, hosts)
+}
+
+// updateAccessLog opens or closes the access log when access_log is toggled
+func updateAccessLog(log *log.Logger, wasEnabled, enabled bool) {
+	if enabled == wasEnabled {
+		return
+	}
+	if !enabled {
+		logger.DisableAccessLog()
+		return
+	}
+	if err := logger.EnableAccessLog(); err != nil {
+		log.Println("Error enabling access log:", err)
+	}
+}
+
+// updateLogSettings reapplies log_output, log_time_format and log_timezone when they change;
+// an invalid value is logged and the current setting kept
+func updateLogSettings(log *log.Logger, oldConfig, newConfig *config.Config) {
+	if !slices.Equal(oldConfig.LogOutput, newConfig.LogOutput) {
+		if err := logger.Configure(newConfig.LogOutput); err != nil {
+			log.Println("Error applying log_output, keeping the current outputs:", err)
+		}
+	}
+	if oldConfig.LogTimeFormat != newConfig.LogTimeFormat || oldConfig.LogTimezone != newConfig.LogTimezone {
+		if err := logger.SetTimeFormat(newConfig.LogTimeFormat, newConfig.LogTimezone); err != nil {
+			log.Println("Error applying log_time_format/log_timezone, keeping the current format:", err)
+		}
 	}
 }
 
@@ -272,6 +588,19 @@ func logConfigChanges(log *log.Logger, oldConfig, newConfig *config.Config) {
 	if oldConfig.KeyFile != newConfig.KeyFile {
 		log.Printf("key_file changed from %s to %s", oldConfig.KeyFile, newConfig.KeyFile)
 	}
+	if !maps.Equal(oldConfig.CertMap, newConfig.CertMap) {
+		log.Printf("cert_map changed, now %d hosts", len(newConfig.CertMap))
+	}
+	if oldConfig.DrainMode != newConfig.DrainMode {
+		log.Printf("drain_mode changed from %t to %t", oldConfig.DrainMode, newConfig.DrainMode)
+	}
+	if hasGRPC := newConfig.HasGRPCRoutes(); hasGRPC != oldConfig.HasGRPCRoutes() {
+		action := "disable"
+		if hasGRPC {
+			action = "enable"
+		}
+		log.Printf("WARNING: grpc routes changed, restart to %s h2c on the HTTP listener", action)
+	}
 
 	// Compare Routes
 	for key := range oldConfig.Routes {
@@ -316,30 +645,43 @@ func logConfigChanges(log *log.Logger, oldConfig, newConfig *config.Config) {
 	}
 }
 
-// reloadCert reloads the SSL certificate from disk
+// selfSignedCheckInterval is how often the self-signed certificate's expiry is checked
+const selfSignedCheckInterval = 12 * time.Hour
+
+// renewSelfSignedCert regenerates and reloads the proxy's own self-signed certificate when it comes
+// within cert_renew_days of expiry; provided certificates are left alone
+func renewSelfSignedCert(log *log.Logger) {
+	for {
+		reloadMutex.Lock()
+		renewed, err := ssl.RenewSelfSigned(currentConfig.CertFile, currentConfig.KeyFile, currentConfig.CertRenewWindow(), slices.Collect(maps.Keys(currentConfig.Routes))...)
+		if err != nil {
+			log.Println("Error checking self-signed certificate expiry:", err)
+		} else if renewed {
+			reloadCert(log)
+		}
+		reloadMutex.Unlock()
+		time.Sleep(selfSignedCheckInterval)
+	}
+}
+
+// reloadCert reloads the SSL certificates from disk
 func reloadCert(log *log.Logger) {
-	cert, err := tls.LoadX509KeyPair(currentConfig.CertFile, currentConfig.KeyFile)
-	if err != nil {
+	if err := certs.Load(currentConfig.CertFile, currentConfig.KeyFile, currentConfig.CertMap); err != nil {
 		log.Println("Error reloading cert:", err)
-		return
 	}
-	certMutex.Lock()
-	currentCert = &cert
-	certMutex.Unlock()
 }
 
 // updateCertWatchers updates the file watcher for new cert file paths
-func updateCertWatchers(log *log.Logger, oldCertFile, oldKeyFile string) {
-	if oldCertFile != currentConfig.CertFile {
-		watcher.Remove(oldCertFile)
-		if err := watcher.Add(currentConfig.CertFile); err != nil {
-			log.Println("Error watching new cert file:", err)
+func updateCertWatchers(oldCertFiles []string) {
+	newCertFiles := currentConfig.CertFiles()
+	for _, file := range oldCertFiles {
+		if !slices.Contains(newCertFiles, file) {
+			watcher.Remove(file)
 		}
 	}
-	if oldKeyFile != currentConfig.KeyFile {
-		watcher.Remove(oldKeyFile)
-		if err := watcher.Add(currentConfig.KeyFile); err != nil {
-			log.Println("Error watching new key file:", err)
+	for _, file := range newCertFiles {
+		if !slices.Contains(oldCertFiles, file) {
+			watcher.Add(file)
 		}
 	}
 }
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"golangproxy/logger"
+)
+
+// credentialPattern finds credential-looking fields in form, JSON or query-style bodies
+var credentialPattern = regexp.MustCompile(`(?i)("?(?:password|passwd|pwd|secret|client_secret|token|access_token|refresh_token|api_?key)"?\s*[:=]\s*)("[^"]*"|[^&\s,}]*)`)
+
+// bodyLog copies up to limit bytes of a request body into the log while it is forwarded;
+// the body itself is streamed unchanged and anything past the limit is only counted
+type bodyLog struct {
+	io.ReadCloser
+	req   *http.Request
+	limit int
+	buf   []byte
+	total int64
+	once  sync.Once
+}
+
+// newBodyLog wraps the request body for logging, leaving bodiless requests alone
+func newBodyLog(req *http.Request, limit int) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	req.Body = &bodyLog{ReadCloser: req.Body, req: req, limit: limit}
+}
+
+func (b *bodyLog) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := b.limit - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(n, room)]...)
+	}
+	b.total += int64(n)
+	if err == io.EOF {
+		b.log()
+	}
+	return n, err
+}
+
+func (b *bodyLog) Close() error {
+	b.log()
+	return b.ReadCloser.Close()
+}
+
+// log writes the captured body once, with credential values redacted
+func (b *bodyLog) log() {
+	b.once.Do(func() {
+		truncated := ""
+		if b.total > int64(len(b.buf)) {
+			truncated = ", truncated"
+		}
+		body := credentialPattern.ReplaceAllString(string(b.buf), "${1}[REDACTED]")
+		logger.Logger.Printf("Request body %s %s%s (%d bytes%s): %q", b.req.Method, b.req.Host, b.req.URL.Path, b.total, truncated, body)
+	})
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// bufferPool hands ReverseProxy fixed-size copy buffers. Responses are streamed one buffer at a
+// time and each write waits for the client, so at most one buffer per request is read ahead
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{size: size, pool: sync.Pool{New: func() any { return make([]byte, size) }}}
+}
+
+func (p *bufferPool) Get() []byte { return p.pool.Get().([]byte) }
+
+func (p *bufferPool) Put(buf []byte) {
+	if len(buf) == p.size {
+		p.pool.Put(buf)
+	}
+}
+
+// bufferLimit is the largest response body buffer_response holds in memory, larger bodies are streamed
+const bufferLimit = 1 << 20
+
+// bufferResponse reads a small response body into memory and closes the target's body, which returns
+// the upstream connection to the pool right away instead of holding it while a slow client reads
+func bufferResponse(resp *http.Response) error {
+	if !hasBody(resp) || resp.Request.Method == http.MethodHead || len(resp.Trailer) > 0 || resp.ContentLength > bufferLimit {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return nil // Server-sent events never end, they must be streamed
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, bufferLimit+1))
+	if err != nil {
+		return err
+	}
+	if len(buf) > bufferLimit {
+		// Larger than announced (or no Content-Length): relay what was read and stream the rest
+		resp.Body = &bufferedBody{Reader: io.MultiReader(bytes.NewReader(buf), resp.Body), Closer: resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(buf))
+	resp.ContentLength = int64(len(buf))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+	return nil
+}
+
+// bufferedBody relays a partly buffered body and closes the target's body when done
+type bufferedBody struct {
+	io.Reader
+	io.Closer
+}
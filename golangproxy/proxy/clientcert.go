@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"golangproxy/logger"
+)
+
+// clientCert presents a client certificate to targets that require mutual TLS and
+// reloads it when the certificate file changes, so renewals apply without a restart
+type clientCert struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newClientCert loads the certificate pair, logging and returning nil if it can't be loaded
+func newClientCert(certFile, keyFile string) *clientCert {
+	c := &clientCert{certFile: certFile, keyFile: keyFile}
+	if _, err := c.load(); err != nil {
+		logger.Logger.Printf("Error loading upstream client cert %s: %v", certFile, err)
+		return nil
+	}
+	return c
+}
+
+// GetClientCertificate is used as tls.Config.GetClientCertificate for the route transport
+func (c *clientCert) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, err := c.load()
+	if err != nil {
+		// Keep presenting the last good certificate while a renewal is half written
+		logger.Logger.Printf("Error reloading upstream client cert %s: %v", c.certFile, err)
+	}
+	return cert, nil
+}
+
+// load returns the cached certificate, reading the files again if the cert file was modified
+func (c *clientCert) load() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return c.cached(), err
+	}
+	if c.cert != nil && info.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return c.cached(), err
+	}
+	c.cert, c.modTime = &cert, info.ModTime()
+	return c.cert, nil
+}
+
+// cached returns the last loaded certificate, or an empty one so the handshake continues without
+func (c *clientCert) cached() *tls.Certificate {
+	if c.cert == nil {
+		return &tls.Certificate{}
+	}
+	return c.cert
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	"golangproxy/logger"
+)
+
+// ConnLimit caps the connections open across all listeners it wraps. At the cap Accept waits, so
+// new connections queue in the kernel's accept backlog until an open one closes
+type ConnLimit struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int // Most open connections (0 = unlimited)
+	open  int // Connections currently open
+}
+
+// NewConnLimit creates a ConnLimit allowing limit connections (0 = unlimited)
+func NewConnLimit(limit int) *ConnLimit {
+	c := &ConnLimit{limit: limit}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// SetLimit changes the cap; connections already open are unaffected
+func (c *ConnLimit) SetLimit(limit int) {
+	c.mu.Lock()
+	c.limit = limit
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+// Open returns the number of connections currently open
+func (c *ConnLimit) Open() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.open
+}
+
+// Listener wraps l so its connections count against the cap
+func (c *ConnLimit) Listener(l net.Listener) net.Listener {
+	return &limitListener{Listener: l, limit: c}
+}
+
+// acquire waits for a free connection slot; it returns false once the listener is closed
+func (c *ConnLimit) acquire(l *limitListener) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	logged := false
+	for c.limit > 0 && c.open >= c.limit && !l.closed {
+		if !logged {
+			logger.Logger.Printf("max_connections of %d reached, new connections wait until one closes", c.limit)
+			logged = true
+		}
+		c.cond.Wait()
+	}
+	if l.closed {
+		return false
+	}
+	c.open++
+	return true
+}
+
+func (c *ConnLimit) release() {
+	c.mu.Lock()
+	c.open--
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+// limitListener takes a slot before accepting each connection
+type limitListener struct {
+	net.Listener
+	limit  *ConnLimit
+	closed bool // Guarded by limit.mu
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if !l.limit.acquire(l) {
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.limit.release()
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: l.limit.release}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.limit.mu.Lock()
+	l.closed = true
+	l.limit.mu.Unlock()
+	l.limit.cond.Broadcast()
+	return l.Listener.Close()
+}
+
+// limitConn frees its slot when closed
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
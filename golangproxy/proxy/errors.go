@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golangproxy/logger"
+)
+
+// errorResponse is the JSON envelope for errors the proxy generates itself
+type errorResponse struct {
+	Status    int    `json:"status"`               // HTTP status code
+	Error     string `json:"error"`                // Status text (e.g., "Bad Gateway")
+	Message   string `json:"message"`              // What the proxy could not do
+	RequestID string `json:"request_id,omitempty"` // X-Request-ID of the request, if the client sent one
+}
+
+//go:embed errorpages/*.html
+var errorPageFiles embed.FS
+
+// errorPages are the built-in HTML pages for the common proxy errors, named "<status>.html"
+var errorPages = template.Must(template.ParseFS(errorPageFiles, "errorpages/*.html"))
+
+// writeError answers with a proxy-generated error, as JSON when the client accepts JSON, as one
+// of the built-in HTML pages for browsers and as plain text ("502 - GoLangProxy: ...") otherwise;
+// target error responses never pass here
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if page := errorPages.Lookup(strconv.Itoa(status) + ".html"); page != nil && !prefersJSON(r) && prefersHTML(r) {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		page.Execute(w, errorResponse{
+			Status:    status,
+			Error:     http.StatusText(status),
+			Message:   message,
+			RequestID: r.Header.Get("X-Request-ID"),
+		})
+		return
+	}
+	if !prefersJSON(r) {
+		http.Error(w, fmt.Sprintf("%d - GoLangProxy: %s", status, message), status)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{
+		Status:    status,
+		Error:     http.StatusText(status),
+		Message:   message,
+		RequestID: r.Header.Get("X-Request-ID"),
+	})
+}
+
+// prefersJSON reports whether the Accept header asks for JSON (application/json or a +json type)
+func prefersJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(strings.TrimSpace(mediaType), ";")
+			if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prefersHTML reports whether the Accept header asks for HTML, as browsers do
+func prefersHTML(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(strings.TrimSpace(mediaType), ";")
+			if mediaType == "text/html" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyErrorHandler replaces ReverseProxy's bare 502 when the target can't be reached,
+// answering with the route's timeout_status when its request_timeout fired
+func proxyErrorHandler(target string, opts RouteOptions) func(http.ResponseWriter, *http.Request, error) {
+	return func(rw http.ResponseWriter, req *http.Request, err error) {
+		if cause := context.Cause(req.Context()); errors.Is(cause, errUpgradeTimeout) {
+			logger.Logger.Printf("http: proxy error for %s: %v", target, cause)
+			writeError(rw, req, http.StatusGatewayTimeout, "websocket handshake timed out")
+			return
+		}
+		// Same wording as ReverseProxy's own log line, so canceled requests are still filtered
+		logger.Logger.Printf("http: proxy error for %s: %v", target, err)
+		if opts.RequestTimeout > 0 && errors.Is(context.Cause(req.Context()), errRequestTimeout) {
+			status, message := opts.TimeoutStatus, opts.TimeoutMessage
+			if status == 0 {
+				status = http.StatusGatewayTimeout
+			}
+			if message == "" {
+				message = "upstream timed out"
+			}
+			writeError(rw, req, status, message)
+			return
+		}
+		writeError(rw, req, http.StatusBadGateway, "upstream unavailable")
+	}
+}
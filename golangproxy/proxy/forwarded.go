@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+)
+
+// Forwarded header modes
+const (
+	ForwardedAdd      = "add"      // Replace X-Forwarded-For with the client IP, set X-Forwarded-Host and -Proto
+	ForwardedPreserve = "preserve" // Pass the client's X-Forwarded-* headers on unchanged, add none
+	ForwardedStrip    = "strip"    // Send no X-Forwarded-* headers at all
+)
+
+// forwardedHeaders are the headers controlled by forwarded_headers
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Port"}
+
+// forwardedForKey carries the client's X-Forwarded-For to forwardedTransport in preserve mode;
+// ReverseProxy appends the client address after the Director unless the header is nil
+type forwardedForKey struct{}
+
+// setForwarded applies the route's forwarded_headers mode to the outgoing request
+func setForwarded(req *http.Request, opts RouteOptions, scheme string) {
+	switch opts.ForwardedHeaders {
+	case ForwardedPreserve:
+		req.Header["X-Forwarded-For"] = nil
+	case ForwardedStrip:
+		for _, name := range forwardedHeaders {
+			req.Header.Del(name)
+		}
+		req.Header["X-Forwarded-For"] = nil
+	default:
+		// The client's chain is dropped, ReverseProxy then writes only the bare client IP
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		req.Header.Set("X-Forwarded-Proto", scheme)
+		if opts.ForwardedPort {
+			setOrDelete(req.Header, "X-Forwarded-Port", listenerPort(req))
+		}
+	}
+	if opts.ClientPortHeader != "" {
+		_, port, _ := net.SplitHostPort(req.RemoteAddr)
+		setOrDelete(req.Header, opts.ClientPortHeader, port)
+	}
+}
+
+// forwardedTransport puts the client's X-Forwarded-For back on requests of preserve routes
+type forwardedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *forwardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if prior, ok := req.Context().Value(forwardedForKey{}).([]string); ok {
+		req = req.Clone(req.Context())
+		req.Header["X-Forwarded-For"] = prior
+	}
+	return t.base.RoundTrip(req)
+}
+
+// setOrDelete sets a header the proxy owns, removing any value the client sent when there is none
+func setOrDelete(h http.Header, key, value string) {
+	if value == "" {
+		h.Del(key)
+		return
+	}
+	h.Set(key, value)
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Duplicate header modes
+const (
+	DuplicateKeep   = "keep"   // Relay every value (default)
+	DuplicateFirst  = "first"  // Keep the first value
+	DuplicateLast   = "last"   // Keep the last value
+	DuplicateReject = "reject" // Answer 502 instead of relaying the response
+)
+
+// singleValuedHeaders may appear once in a response; strict clients refuse or misread repeats.
+// Header names are already canonical here, the transport canonicalizes them when parsing
+var singleValuedHeaders = []string{
+	"Content-Type", "Content-Length", "Content-Location", "Content-Disposition", "Content-Range",
+	"Location", "Etag", "Last-Modified", "Expires", "Date", "Age", "Retry-After",
+	"Access-Control-Allow-Origin", "Strict-Transport-Security", "Server",
+}
+
+// dedupeHeaders applies duplicate_headers to single-valued headers the target sent more than once
+func dedupeHeaders(h http.Header, mode string) error {
+	if mode == "" || mode == DuplicateKeep {
+		return nil
+	}
+	for _, name := range singleValuedHeaders {
+		values := h[name]
+		if len(values) < 2 {
+			continue
+		}
+		switch mode {
+		case DuplicateFirst:
+			h[name] = values[:1]
+		case DuplicateLast:
+			h[name] = values[len(values)-1:]
+		case DuplicateReject:
+			return fmt.Errorf("target sent %d %s headers", len(values), name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golangproxy/logger"
+)
+
+// maxMirrorBody is the largest request body buffered for mirroring; bigger requests are not mirrored
+const maxMirrorBody = 10 << 20
+
+// maxMirrorInFlight caps the mirrored requests running at once per mirror; while a slow shadow
+// target holds them all, further copies are dropped instead of piling up buffered bodies
+const maxMirrorInFlight = 32
+
+// hopHeaders apply to a single connection and are never copied to the mirror (RFC 9110 section 7.6.1)
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// mirror sends copies of requests to a shadow target and discards the responses
+type mirror struct {
+	target  *url.URL
+	percent int
+	client  *http.Client
+	slots   chan struct{} // One per mirrored request in flight, up to maxMirrorInFlight
+	opts    RouteOptions  // Path rewrites applied like the Director's, so the shadow sees the primary's path
+}
+
+// newMirror builds a mirror for the target URL, or returns nil when mirroring is off
+func newMirror(target string, percent int, opts RouteOptions) *mirror {
+	if target == "" {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		logger.Logger.Printf("Invalid mirror_to %q, mirroring disabled", target)
+		return nil
+	}
+	if percent <= 0 || percent > 100 {
+		percent = 100
+	}
+	return &mirror{
+		target:  u,
+		percent: percent,
+		slots:   make(chan struct{}, maxMirrorInFlight),
+		opts:    opts,
+		client: &http.Client{
+			Transport: newTransport(u, opts),
+			Timeout:   30 * time.Second,
+			// Redirects are the client's business, the mirror only needs one response
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// send copies the request to the mirror target in the background when it is sampled.
+// The body is buffered and req.Body replaced so the primary upstream still receives it;
+// that copy, capped at maxMirrorBody, is the only part done before the primary request.
+func (m *mirror) send(req *http.Request) {
+	if rand.IntN(100) >= m.percent {
+		return
+	}
+	if isUpgrade(req.Header) {
+		return // A handshake means nothing without the tunnel behind it
+	}
+	if req.ContentLength > maxMirrorBody {
+		logger.Logger.Printf("Mirror skipped for %s%s: request body too large or unreadable", req.Host, req.URL.Path)
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		logger.Logger.Printf("Mirror skipped for %s%s: %d mirrored requests to %s already in flight", req.Host, req.URL.Path, maxMirrorInFlight, m.target.Host)
+		return
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		data, err := io.ReadAll(io.LimitReader(req.Body, maxMirrorBody+1))
+		// Whatever was read is put back in front of the unread rest for the primary
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+		if err != nil || len(data) > maxMirrorBody {
+			logger.Logger.Printf("Mirror skipped for %s%s: request body too large or unreadable", req.Host, req.URL.Path)
+			<-m.slots
+			return
+		}
+		body = data
+	}
+
+	shadow := req.Clone(context.Background())
+	go func() {
+		defer func() { <-m.slots }()
+		rawPath := preservedPath(shadow, m.opts)
+		stripPathPrefix(shadow.URL, m.opts.StripPathPrefix)
+		applyTrailingSlash(shadow.URL, m.opts.TrailingSlash)
+		shadow.RequestURI = ""
+		shadow.URL.Scheme = m.target.Scheme
+		shadow.URL.Host = m.target.Host
+		shadow.URL.Path = singleJoiningSlash(m.target.Path, shadow.URL.Path)
+		shadow.URL.RawPath = ""
+		if rawPath != nil {
+			if joined := singleJoiningSlash(m.target.EscapedPath(), rawPath.Path); !strings.HasPrefix(joined, "//") {
+				shadow.URL.Opaque = joined
+			}
+		}
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+		shadow.ContentLength = int64(len(body))
+		shadow.TransferEncoding = nil
+		shadow.Trailer = nil
+		removeHopHeaders(shadow.Header)
+		shadow.Header.Set("X-Forwarded-Host", shadow.Host)
+
+		resp, err := m.client.Do(shadow)
+		if err != nil {
+			logger.Logger.Printf("Mirror error for %s: %v", m.target, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// removeHopHeaders drops the hop-by-hop headers and those the Connection header names
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// singleJoiningSlash joins two URL paths with exactly one slash between them
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
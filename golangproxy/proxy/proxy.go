@@ -2,11 +2,23 @@ package proxy
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golangproxy/logger"
 )
@@ -17,22 +29,117 @@ type Route struct {
 	Handler         http.Handler           // Custom handler wrapping the proxy
 	NoHTTPSRedirect bool                   // Disable HTTP to HTTPS redirect
 	Target          string                 // Target URL for proxying
+	Options         RouteOptions           // Options the route was built with
+	Readiness       bool                   // Local readiness path, answers 503 while draining
 }
 
+// RouteOptions holds optional per-route settings used when building a route
+type RouteOptions struct {
+	TrustInvalidCert     bool          // Skip verification of the target certificate
+	NoHTTPSRedirect      bool          // Disable HTTP to HTTPS redirect
+	UpstreamProxy        string        // HTTP(S) or SOCKS5 proxy used to reach the target (e.g., "socks5://bastion:1080")
+	AnswerExpectContinue bool          // Answer "Expect: 100-continue" at the proxy instead of forwarding it
+	OptionsMode          string        // Handling of OPTIONS requests: "pass" (default), "respond" or "reject"
+	LogTiming            bool          // Log upstream latency breakdown for every request
+	UpstreamH2C          bool          // Speak HTTP/2 cleartext (prior knowledge) to http:// targets
+	DisableKeepAlive     bool          // Open a fresh upstream connection per request (sends Connection: close)
+	AccessLog            bool          // Write a combined-format line per request to the access log
+	DefaultContentType   string        // Content-Type set on upstream responses that have a body but no type
+	MirrorTo             string        // Shadow target receiving a copy of each request (responses are discarded)
+	MirrorPercent        int           // Percentage of requests mirrored (1-100, default 100)
+	TrailingSlash        string        // Path trailing slash handling: "keep" (default), "add" or "remove"
+	GRPC                 bool          // gRPC target: HTTP/2 end to end, unbuffered streaming, gRPC-style errors
+	MaxResponseBody      int64         // Largest upstream response body relayed in bytes (0 = unlimited)
+	UpstreamClientCert   string        // Client certificate presented to https:// targets requiring mutual TLS
+	UpstreamClientKey    string        // Key for UpstreamClientCert
+	StripPathPrefix      string        // Path prefix removed before joining with the target path (e.g., "/app")
+	LogRequestBody       int           // Log up to this many bytes of each request body (0 = off)
+	UpstreamHostTemplate string        // Host header sent upstream, with {host} and {subdomain} placeholders
+	DevMode              bool          // Development shortcut: trust certificates of loopback targets
+	RequestTimeout       time.Duration // Longest wait for the target's response headers, bodies and upgrades aren't limited (0 = no limit)
+	TimeoutStatus        int           // Status returned when RequestTimeout fires (default 504)
+	TimeoutMessage       string        // Message returned when RequestTimeout fires
+	PreserveRawPath      bool          // Forward the path exactly as the client encoded it
+	AccessLogSample      int           // Write 1 in N successful access lines (0 or 1 = all); errors and slow requests always
+	ChaosEnabled         bool          // Allow InjectDelay; never set in production
+	InjectDelay          string        // Delay added before proxying, fixed ("500ms") or a random range ("100ms-2s")
+	RetryOnStatus        []int         // Target statuses retried for idempotent requests without a body
+	RetryCount           int           // Retries for RetryOnStatus (default 1)
+	UpstreamPins         []string      // Base64 SHA-256 SPKI hashes, the target's certificate key must match one
+	UpgradeTimeout       time.Duration // Longest wait for the target's answer to a WebSocket handshake (default 10s)
+	BufferResponse       bool          // Read bodies up to 1 MiB into memory, freeing the upstream connection before slow clients finish
+	MaxHeaderValue       int           // Longest single request header value in bytes, longer ones get 431 (0 = no limit)
+	StreamBuffer         int           // Bytes of a streamed response read ahead of the client (default 32 KiB)
+	DebugHeaders         bool          // Add X-Proxy-Upstream and X-Proxy-Duration-Ms to responses (staging only)
+	DuplicateHeaders     string        // Repeated single-valued response headers: keep (default), first, last or reject
+	RestrictRedirects    bool          // Only relay redirects to the request's own host or RedirectAllow, others get 502
+	RedirectAllow        []string      // Extra hosts redirects may point to with RestrictRedirects ("*.example.com" for subdomains)
+	ForwardedPort        bool          // Send the port of the listener the request arrived on as X-Forwarded-Port
+	ClientPortHeader     string        // Header carrying the client's source port to the target (e.g., "X-Client-Port")
+	UpstreamKeepAlive    time.Duration // TCP keep-alive probe interval on upstream connections (0 = default of 30s, negative = off)
+	UpstreamIdleTimeout  time.Duration // Pooled upstream connections idle this long are closed (0 = Go default of 90s)
+	ForwardedHeaders     string        // X-Forwarded-* headers: add (default), preserve the client's or strip
+}
+
+// OPTIONS handling modes
+const (
+	OptionsPass    = "pass"    // Proxy OPTIONS requests to the target
+	OptionsRespond = "respond" // Answer with 204 and an Allow header
+	OptionsReject  = "reject"  // Answer with 405 Method Not Allowed
+)
+
+// Trailing slash modes
+const (
+	TrailingSlashKeep   = "keep"   // Forward paths unchanged
+	TrailingSlashAdd    = "add"    // Append "/" to directory-like paths (last segment without a dot)
+	TrailingSlashRemove = "remove" // Strip trailing "/" except from the root path
+)
+
+// allowedMethods is advertised in the Allow header when the proxy answers OPTIONS itself
+const allowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
 // CreateRoute initializes a reverse proxy for a target with trust settings
 func CreateRoute(target string, trustInvalidCert bool) *Route {
+	return CreateRouteWithOptions(target, RouteOptions{TrustInvalidCert: trustInvalidCert})
+}
+
+// CreateRouteWithOptions initializes a reverse proxy for a target with the given route options
+func CreateRouteWithOptions(target string, opts RouteOptions) *Route {
 	url, _ := url.Parse(target)
 	proxy := httputil.NewSingleHostReverseProxy(url)
-	if url.Scheme == "https" {
-		proxy.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: trustInvalidCert},
+	proxy.Transport = newTransport(url, opts)
+	if len(opts.RetryOnStatus) > 0 {
+		retries := opts.RetryCount
+		if retries <= 0 {
+			retries = 1
 		}
+		proxy.Transport = &retryTransport{base: proxy.Transport, statuses: opts.RetryOnStatus, retries: retries}
+	}
+	if opts.ForwardedHeaders == ForwardedPreserve {
+		proxy.Transport = &forwardedTransport{base: proxy.Transport}
+	}
+
+	if opts.StreamBuffer > 0 {
+		proxy.BufferPool = newBufferPool(opts.StreamBuffer)
 	}
 
 	// Modify the Director based on whether the target is an IP or hostname
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
+		incomingHost := req.Host
+		if body, ok := req.Body.(*trailerBody); ok {
+			body.dst = req.Trailer
+		}
+		rawPath := preservedPath(req, opts)
+		stripPathPrefix(req.URL, opts.StripPathPrefix)
+		applyTrailingSlash(req.URL, opts.TrailingSlash)
 		originalDirector(req)
+		if rawPath != nil {
+			// An opaque URL is written to the target verbatim, without re-escaping the path
+			if joined := singleJoiningSlash(url.EscapedPath(), rawPath.Path); !strings.HasPrefix(joined, "//") {
+				req.URL.Opaque = joined
+			}
+		}
 		if isIPTarget(url.Hostname()) {
 			// For IP targets, preserve the incoming Host header (e.g., main.example.com)
 			// This ensures session cookies match the client's requested domain
@@ -40,19 +147,204 @@ func CreateRoute(target string, trustInvalidCert bool) *Route {
 			// For hostname targets, set Host to the target's hostname (e.g., example.com)
 			req.Host = url.Host
 		}
-		req.Header.Set("X-Forwarded-For", req.RemoteAddr)
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Header.Set("X-Forwarded-Proto", url.Scheme)
+		// WebSocket and other upgrades are handled entirely by ReverseProxy: it drops the
+		// hop-by-hop headers, sends "Connection: Upgrade" with the Upgrade header upstream and
+		// hijacks the client connection on 101, so the Director never sets Connection itself
+		normalizeUpgrade(req.Header)
+		if opts.AnswerExpectContinue {
+			// Without the header upstream, the body is streamed at once and the
+			// server replies "100 Continue" to the client as soon as it is read
+			req.Header.Del("Expect")
+		}
+		setForwarded(req, opts, url.Scheme)
 		if req.Header.Get("User-Agent") == "" {
 			req.Header.Set("User-Agent", "GoLangProxy")
 		}
+		if opts.UpstreamHostTemplate != "" {
+			req.Host = renderHostTemplate(opts.UpstreamHostTemplate, incomingHost)
+		}
 		//logger.Logger.Printf("Proxying to %s - Headers: %v, Cookies: %v", target, req.Header, req.Cookies())
 	}
 
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if err := stopResponseTimer(resp); err != nil {
+			return err
+		}
+		if len(resp.Trailer) > 0 {
+			// HTTP/2 upstreams may send Content-Length alongside trailers; drop it so
+			// HTTP/1.1 clients get a chunked response that can carry the trailers
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+		}
+		if opts.RestrictRedirects {
+			if err := checkRedirect(resp, opts.RedirectAllow); err != nil {
+				return err
+			}
+		}
+		if resp.Request.Context().Value(strippedPrefixKey{}) != nil {
+			// The target doesn't know about the stripped prefix, keep its redirects under it
+			if location := resp.Header.Get("Location"); strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+				resp.Header.Set("Location", strings.TrimSuffix(opts.StripPathPrefix, "/")+location)
+			}
+		}
+		// A 101 body is the upgraded connection, ReverseProxy needs it writable and it has no size
+		if opts.MaxResponseBody > 0 && resp.StatusCode != http.StatusSwitchingProtocols {
+			if resp.ContentLength > opts.MaxResponseBody {
+				// Known to be too large before anything was sent, the client gets a 502
+				return fmt.Errorf("response body of %d bytes exceeds max_response_body of %d bytes", resp.ContentLength, opts.MaxResponseBody)
+			}
+			// Bodies without a length are cut off once they pass the limit
+			resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: opts.MaxResponseBody, limit: opts.MaxResponseBody}
+		}
+		if isGRPC(resp.Header) {
+			// gRPC status travels in trailers, never touch the body or its headers
+			return nil
+		}
+		if err := dedupeHeaders(resp.Header, opts.DuplicateHeaders); err != nil {
+			return err
+		}
+		if opts.DefaultContentType != "" && hasBody(resp) && len(resp.Header.Values("Content-Type")) == 0 {
+			resp.Header.Set("Content-Type", opts.DefaultContentType)
+		}
+		if opts.BufferResponse {
+			return bufferResponse(resp)
+		}
+		return nil
+	}
+
+	proxy.ErrorHandler = proxyErrorHandler(target, opts)
+	if opts.GRPC {
+		// Relay every message frame as soon as it arrives for streaming RPCs
+		proxy.FlushInterval = -1
+		proxy.ErrorHandler = grpcErrorHandler(target)
+	}
+
+	switch opts.OptionsMode {
+	case "", OptionsPass, OptionsRespond, OptionsReject:
+	default:
+		logger.Logger.Printf("Unknown options_mode %q for %s, passing OPTIONS through", opts.OptionsMode, target)
+	}
+
+	shadow := newMirror(opts.MirrorTo, opts.MirrorPercent, RouteOptions{
+		TrustInvalidCert: opts.TrustInvalidCert, UpstreamProxy: opts.UpstreamProxy, DevMode: opts.DevMode,
+		StripPathPrefix: opts.StripPathPrefix, TrailingSlash: opts.TrailingSlash, PreserveRawPath: opts.PreserveRawPath,
+	})
+
+	var accessCount atomic.Uint64 // Requests seen for access log sampling
+
+	var delayMin, delayMax time.Duration
+	if opts.ChaosEnabled && opts.InjectDelay != "" {
+		var err error
+		if delayMin, delayMax, err = parseDelay(opts.InjectDelay); err != nil {
+			logger.Logger.Printf("Invalid inject_delay %q for %s, no delay injected: %v", opts.InjectDelay, target, err)
+		}
+	}
+
+	switch opts.DuplicateHeaders {
+	case "", DuplicateKeep, DuplicateFirst, DuplicateLast, DuplicateReject:
+	default:
+		logger.Logger.Printf("Invalid duplicate_headers %q for %s, repeated headers are relayed unchanged", opts.DuplicateHeaders, target)
+	}
+	switch opts.ForwardedHeaders {
+	case "", ForwardedAdd, ForwardedPreserve, ForwardedStrip:
+	default:
+		logger.Logger.Printf("Invalid forwarded_headers %q for %s, adding X-Forwarded-* headers", opts.ForwardedHeaders, target)
+	}
+
 	// Create a custom handler to wrap the proxy and filter context canceled errors
 	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		rwWrapper := &responseWriterWrapper{ResponseWriter: rw}
-		proxy.ServeHTTP(rwWrapper, req)
+		if opts.DebugHeaders {
+			rwWrapper.Header().Set("X-Proxy-Upstream", target)
+			rwWrapper.debugStart = time.Now()
+		}
+		// Request smuggling: net/http already answers conflicting Content-Length values with 400 and
+		// any Transfer-Encoding other than a single "chunked" with 501, and ReverseProxy re-frames the
+		// request for the target. A chunked request may also have carried a Content-Length, which
+		// net/http drops without a trace, so the connection is closed after it (RFC 9112 6.1) and
+		// bytes a front proxy counted as body are never read as a new request
+		if len(req.TransferEncoding) > 0 && req.ProtoMajor == 1 {
+			rwWrapper.Header().Set("Connection", "close")
+		}
+		if opts.MaxHeaderValue > 0 {
+			if name, size := longestHeader(req.Header); size > opts.MaxHeaderValue {
+				writeError(rwWrapper, req, http.StatusRequestHeaderFieldsTooLarge,
+					fmt.Sprintf("header %s is %d bytes, this site accepts at most %d", name, size, opts.MaxHeaderValue))
+				return
+			}
+		}
+		if opts.LogRequestBody > 0 {
+			newBodyLog(req, opts.LogRequestBody)
+		}
+		if len(req.Trailer) > 0 {
+			req.Body = &trailerBody{ReadCloser: req.Body, src: req.Trailer}
+		}
+		if opts.AccessLog {
+			start := time.Now()
+			defer func() {
+				if sampleAccess(&accessCount, opts.AccessLogSample, rwWrapper.status, time.Since(start)) {
+					logAccess(req, rwWrapper)
+				}
+			}()
+		}
+		if req.Method == http.MethodOptions {
+			switch opts.OptionsMode {
+			case OptionsRespond:
+				rwWrapper.Header().Set("Allow", allowedMethods)
+				rwWrapper.WriteHeader(http.StatusNoContent)
+				return
+			case OptionsReject:
+				rwWrapper.Header().Set("Allow", strings.Replace(allowedMethods, ", OPTIONS", "", 1))
+				writeError(rwWrapper, req, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+		}
+		if delayMax > 0 {
+			delay := delayMin
+			if delayMax > delayMin {
+				delay += rand.N(delayMax - delayMin + 1)
+			}
+			logger.Logger.Printf("Chaos: delaying %s %s%s by %s", req.Method, req.Host, req.URL.Path, delay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		if shadow != nil {
+			shadow.send(req)
+		}
+		if opts.RestrictRedirects {
+			req = req.WithContext(context.WithValue(req.Context(), clientHostKey{}, req.Host))
+		}
+		if opts.StripPathPrefix != "" && stripsPathPrefix(req, opts) {
+			req = req.WithContext(context.WithValue(req.Context(), strippedPrefixKey{}, true))
+		}
+		if prior, ok := req.Header["X-Forwarded-For"]; ok && opts.ForwardedHeaders == ForwardedPreserve {
+			req = req.WithContext(context.WithValue(req.Context(), forwardedForKey{}, prior))
+		}
+		if isUpgrade(req.Header) {
+			// The tunnel may stay open for hours, only the wait for the target's 101 is limited
+			ctx, cancel := handshakeContext(req.Context(), opts.UpgradeTimeout)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		if opts.RequestTimeout > 0 && !isUpgrade(req.Header) {
+			// Only the wait for the response headers is limited, not slow bodies
+			ctx, cancel := responseTimeoutContext(req.Context(), opts.RequestTimeout)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		if opts.LogTiming {
+			timing := &requestTiming{start: time.Now()}
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), timing.trace()))
+			proxy.ServeHTTP(rwWrapper, req)
+			timing.log(req, target, rwWrapper.status)
+		} else {
+			proxy.ServeHTTP(rwWrapper, req)
+		}
 		if err := req.Context().Err(); err != nil && err != context.Canceled {
 			logger.Logger.Printf("Proxy error for %s: %v", target, err)
 		}
@@ -60,10 +352,313 @@ func CreateRoute(target string, trustInvalidCert bool) *Route {
 	})
 
 	return &Route{
-		Proxy:   proxy,
-		Handler: handler,
-		Target:  target,
+		Proxy:           proxy,
+		Handler:         handler,
+		NoHTTPSRedirect: opts.NoHTTPSRedirect,
+		Target:          target,
+		Options:         opts,
+	}
+}
+
+// ReuseOrCreate returns the existing route when its target and options are unchanged,
+// keeping its transport and pooled connections, and builds a new route otherwise
+func ReuseOrCreate(existing *Route, target string, opts RouteOptions) *Route {
+	if existing != nil && existing.Target == target && reflect.DeepEqual(existing.Options, opts) {
+		return existing
+	}
+	return CreateRouteWithOptions(target, opts)
+}
+
+// newTransport builds the upstream transport for a route
+func newTransport(target *url.URL, opts RouteOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// HTTP/2 to TLS targets is only used for gRPC routes
+	transport.ForceAttemptHTTP2 = opts.GRPC
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored unless upstream_proxy is set
+	transport.Proxy = http.ProxyFromEnvironment
+	if opts.UpstreamProxy != "" {
+		proxyURL, err := url.Parse(opts.UpstreamProxy)
+		if err != nil || proxyURL.Host == "" {
+			logger.Logger.Printf("Invalid upstream_proxy %q for %s, using environment settings", opts.UpstreamProxy, target)
+		} else {
+			// net/http dials socks5:// proxies itself, http(s):// proxies get CONNECT or absolute-form requests
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+	// The transport sends "Connection: close" upstream when keep-alives are disabled
+	transport.DisableKeepAlives = opts.DisableKeepAlive
+	if opts.UpstreamKeepAlive != 0 {
+		// TCP keep-alive probes find half-open connections to targets that died without closing them
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: opts.UpstreamKeepAlive}
+		transport.DialContext = dialer.DialContext
+	}
+	if opts.UpstreamIdleTimeout > 0 {
+		// Pooled connections are dropped before they go stale, e.g. behind NATs or load balancers
+		// that forget idle flows; a reused connection failing before the response is retried by
+		// the transport for idempotent requests
+		transport.IdleConnTimeout = opts.UpstreamIdleTimeout
+	}
+	// Forwarded "Expect: 100-continue" requests wait this long for the target's
+	// interim response; the client gets its "100 Continue" once the body is sent
+	transport.ExpectContinueTimeout = time.Second
+	if target.Scheme == "https" {
+		// dev_mode trusts local development backends (self-signed certs on localhost) without trust_target
+		trust := opts.TrustInvalidCert || (opts.DevMode && isLoopbackTarget(target.Hostname()))
+		verify := logUpstreamCert(target.Host)
+		if len(opts.UpstreamPins) > 0 {
+			// Pins are checked with or without CA verification, so trust_target plus a pin accepts only that key
+			verify = checkUpstreamPins(target.Host, opts.UpstreamPins, verify)
+		}
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: trust, VerifyConnection: verify}
+		if opts.UpstreamClientCert != "" {
+			if cert := newClientCert(opts.UpstreamClientCert, opts.UpstreamClientKey); cert != nil {
+				transport.TLSClientConfig.GetClientCertificate = cert.GetClientCertificate
+			}
+		}
+	}
+	if (opts.UpstreamH2C || opts.GRPC) && target.Scheme == "http" {
+		// Only unencrypted HTTP/2 is enabled, so requests never fall back to HTTP/1.1;
+		// trailers and streamed bodies are relayed by ReverseProxy as they arrive
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = &protocols
+	}
+	return transport
+}
+
+// logUpstreamCert logs the subject, issuer and expiry of the certificate a target presents the first
+// time the route's transport sees it; it runs even when trust_target skips verification, so unexpected
+// certs show up. The seen set lives in the closure and goes away with the route on reload
+func logUpstreamCert(host string) func(tls.ConnectionState) error {
+	var seen sync.Map // Serial numbers already logged
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+		cert := cs.PeerCertificates[0]
+		if _, logged := seen.LoadOrStore(cert.SerialNumber.String(), true); !logged {
+			logger.Logger.Printf("Upstream %s certificate: subject=%q issuer=%q expires=%s",
+				host, cert.Subject.String(), cert.Issuer.String(), cert.NotAfter.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+// checkUpstreamPins fails the TLS handshake unless the SHA-256 hash of the leaf certificate's public key
+// (SPKI, base64 with an optional "sha256/" prefix) is one of the pins, so a certificate from a
+// compromised CA is still refused
+func checkUpstreamPins(host string, pins []string, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if err := next(cs); err != nil {
+			return err
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("upstream %s presented no certificate to check against upstream_pin", host)
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		hash := base64.StdEncoding.EncodeToString(sum[:])
+		for _, pin := range pins {
+			if strings.TrimPrefix(strings.TrimSpace(pin), "sha256/") == hash {
+				return nil
+			}
+		}
+		logger.Logger.Printf("Upstream %s certificate key sha256/%s matches no upstream_pin, connection refused", host, hash)
+		return fmt.Errorf("upstream %s certificate key does not match upstream_pin", host)
+	}
+}
+
+// renderHostTemplate fills upstream_host_template: {host} is the request host without port and
+// {subdomain} its first label, so "{subdomain}.origin.internal" maps app.example.com to app.origin.internal
+func renderHostTemplate(template, host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	subdomain, _, _ := strings.Cut(host, ".")
+	return strings.NewReplacer("{host}", host, "{subdomain}", subdomain).Replace(template)
+}
+
+// preservedPath returns the rewritten request path exactly as the client encoded it for
+// preserve_raw_path routes, and nil otherwise; on the wire "%2F" is not a segment boundary
+func preservedPath(req *http.Request, opts RouteOptions) *url.URL {
+	if !opts.PreserveRawPath {
+		return nil
+	}
+	// The escaped form is kept in Path so the usual rewrites work on it unchanged
+	raw := &url.URL{Path: clientRawPath(req)}
+	stripPathPrefix(raw, opts.StripPathPrefix)
+	applyTrailingSlash(raw, opts.TrailingSlash)
+	return raw
+}
+
+// clientRawPath returns the request path as the client encoded it, without the query
+func clientRawPath(req *http.Request) string {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.EscapedPath()
+	} else if !strings.HasPrefix(uri, "/") {
+		// Absolute form ("http://host/path"), keep what follows the authority
+		_, rest, _ := strings.Cut(uri, "://")
+		uri = "/"
+		if slash := strings.IndexByte(rest, '/'); slash >= 0 {
+			uri = rest[slash:]
+		}
+	}
+	path, _, _ := strings.Cut(uri, "?")
+	return path
+}
+
+// strippedPrefixKey marks requests the Director removes strip_path_prefix from, only their
+// redirects are moved back under the prefix
+type strippedPrefixKey struct{}
+
+// stripsPathPrefix reports whether strip_path_prefix applies to the request, checked on the
+// same path the Director strips it from
+func stripsPathPrefix(req *http.Request, opts RouteOptions) bool {
+	path := req.URL.Path
+	if opts.PreserveRawPath {
+		path = clientRawPath(req)
+	}
+	return stripPathPrefix(&url.URL{Path: path}, opts.StripPathPrefix)
+}
+
+// stripPathPrefix removes a leading path prefix on a segment boundary, so "/app" turns
+// "/app/page" into "/page" and "/app" into "/" but leaves "/apple" alone; it reports whether it did
+func stripPathPrefix(u *url.URL, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return false
+	}
+	strip := func(p string) (string, bool) {
+		if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			return p, false
+		}
+		if p = strings.TrimPrefix(p, prefix); p == "" {
+			p = "/"
+		}
+		return p, true
+	}
+	path, ok := strip(u.Path)
+	if !ok {
+		return false
 	}
+	u.Path = path
+	if u.RawPath != "" {
+		u.RawPath, _ = strip(u.RawPath)
+	}
+	return true
+}
+
+// applyTrailingSlash adds or removes the trailing slash of the request path; the query is untouched
+func applyTrailingSlash(u *url.URL, mode string) {
+	switch mode {
+	case TrailingSlashAdd:
+		last := u.Path[strings.LastIndex(u.Path, "/")+1:]
+		if !strings.HasSuffix(u.Path, "/") && !strings.Contains(last, ".") {
+			u.Path += "/"
+			if u.RawPath != "" {
+				u.RawPath += "/"
+			}
+		}
+	case TrailingSlashRemove:
+		if len(u.Path) > 1 && strings.HasSuffix(u.Path, "/") {
+			u.Path = strings.TrimRight(u.Path, "/")
+			if u.Path == "" {
+				u.Path = "/"
+			}
+			if u.RawPath != "" {
+				u.RawPath = strings.TrimRight(u.RawPath, "/")
+			}
+		}
+	}
+}
+
+// isGRPC reports whether headers carry a gRPC content type (application/grpc, application/grpc+proto, ...)
+func isGRPC(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), "application/grpc")
+}
+
+// grpcErrorHandler answers failed gRPC calls with status UNAVAILABLE in a trailers-only
+// response, which gRPC clients understand, instead of a plain-text 502
+func grpcErrorHandler(target string) func(http.ResponseWriter, *http.Request, error) {
+	return func(rw http.ResponseWriter, req *http.Request, err error) {
+		logger.Logger.Printf("http: proxy error for %s: %v", target, err)
+		if !isGRPC(req.Header) {
+			writeError(rw, req, http.StatusBadGateway, "upstream unavailable")
+			return
+		}
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Grpc-Status", "14") // UNAVAILABLE
+		rw.Header().Set("Grpc-Message", "upstream unavailable")
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// trailerBody forwards request trailers: the server fills the inbound request's Trailer
+// map once the body is read, but the upstream request got its own copy when it was
+// cloned, so the values are copied over at EOF before the transport sends them
+type trailerBody struct {
+	io.ReadCloser
+	src http.Header // Trailer map of the inbound request
+	dst http.Header // Trailer map of the outgoing request, set by the Director
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && b.dst != nil {
+		for k, vv := range b.src {
+			b.dst[k] = vv
+		}
+	}
+	return n, err
+}
+
+// limitedBody fails reads once more than limit bytes came from the upstream, which makes
+// ReverseProxy abort the response instead of relaying a runaway body
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64 // Bytes still allowed
+	limit     int64 // Configured max_response_body
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, fmt.Errorf("response body exceeds max_response_body of %d bytes", b.limit)
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1] // Read one byte past the limit to detect an oversized body
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n - 1, fmt.Errorf("response body exceeds max_response_body of %d bytes", b.limit)
+	}
+	return n, err
+}
+
+// longestHeader returns the name and size of the longest single request header value
+func longestHeader(h http.Header) (string, int) {
+	var name string
+	var size int
+	for key, values := range h {
+		for _, value := range values {
+			if len(value) > size {
+				name, size = key, len(value)
+			}
+		}
+	}
+	return name, size
+}
+
+// hasBody reports whether a response carries a regular body (not an upgrade, 1xx, 204 or 304)
+func hasBody(resp *http.Response) bool {
+	switch {
+	case resp.StatusCode < 200, resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusNotModified:
+		return false
+	case resp.ContentLength == 0:
+		return false
+	}
+	return true
 }
 
 // isIPTarget checks if the target hostname is an IP address
@@ -77,20 +672,136 @@ func isIPTarget(host string) bool {
 	return net.ParseIP(hostname) != nil
 }
 
+// isLoopbackTarget reports whether a target hostname is localhost or a loopback IP (127.0.0.0/8, ::1)
+func isLoopbackTarget(hostname string) bool {
+	if strings.EqualFold(hostname, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requestTiming records when a proxied request reached the upstream milestones
+type requestTiming struct {
+	start         time.Time // Request entered the route handler
+	upstreamStart time.Time // Transport started getting an upstream connection
+	firstByte     time.Time // First response byte arrived from the upstream
+}
+
+func (t *requestTiming) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			if t.upstreamStart.IsZero() {
+				t.upstreamStart = time.Now()
+			}
+		},
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+}
+
+// log writes the timing breakdown: time to first upstream byte, total upstream time
+// (until the body was relayed) and proxy overhead before the upstream was contacted
+func (t *requestTiming) log(req *http.Request, target string, status int) {
+	end := time.Now()
+	upstreamStart := t.upstreamStart
+	if upstreamStart.IsZero() {
+		upstreamStart = end
+	}
+	var ttfb time.Duration
+	if !t.firstByte.IsZero() {
+		ttfb = t.firstByte.Sub(upstreamStart)
+	}
+	logger.Logger.Printf("Timing %s %s%s -> %s status=%d upstream_ttfb_ms=%.3f upstream_total_ms=%.3f proxy_overhead_ms=%.3f total_ms=%.3f",
+		req.Method, req.Host, req.URL.Path, target, status,
+		millis(ttfb), millis(end.Sub(upstreamStart)), millis(upstreamStart.Sub(t.start)), millis(end.Sub(t.start)))
+}
+
+// millis converts a duration to fractional milliseconds
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// parseDelay reads an inject_delay value: a duration ("500ms") or a range ("100ms-2s")
+func parseDelay(value string) (time.Duration, time.Duration, error) {
+	low, high, isRange := strings.Cut(value, "-")
+	shortest, err := time.ParseDuration(strings.TrimSpace(low))
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return shortest, shortest, nil
+	}
+	longest, err := time.ParseDuration(strings.TrimSpace(high))
+	if err != nil {
+		return 0, 0, err
+	}
+	if longest < shortest {
+		return 0, 0, fmt.Errorf("range end %s is before start %s", longest, shortest)
+	}
+	return shortest, longest, nil
+}
+
+// slowRequest is the duration after which a request is always access logged despite sampling
+const slowRequest = time.Second
+
+// sampleAccess decides whether a finished request gets an access line: errors (4xx/5xx) and
+// slow requests always do, other requests 1 in every sample
+func sampleAccess(count *atomic.Uint64, sample, status int, elapsed time.Duration) bool {
+	if sample <= 1 || status >= 400 || elapsed >= slowRequest {
+		return true
+	}
+	return count.Add(1)%uint64(sample) == 1
+}
+
+// logAccess writes a combined log format line for a finished request to the access log
+func logAccess(req *http.Request, rw *responseWriterWrapper) {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	size := "-"
+	if rw.bytes > 0 {
+		size = strconv.FormatInt(rw.bytes, 10)
+	}
+	referer, userAgent := req.Referer(), req.UserAgent()
+	if referer == "" {
+		referer = "-"
+	}
+	if userAgent == "" {
+		userAgent = "-"
+	}
+	logger.AccessLogger.Printf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"",
+		client, time.Now().Format("02/Jan/2006:15:04:05 -0700"), req.Method, req.RequestURI, req.Proto,
+		rw.status, size, referer, userAgent)
+}
+
 // responseWriterWrapper captures response status and headers
 type responseWriterWrapper struct {
 	http.ResponseWriter
-	status int
+	status     int
+	bytes      int64
+	debugStart time.Time // Set with debug_headers to add X-Proxy-Duration-Ms
 }
 
 func (rw *responseWriterWrapper) WriteHeader(status int) {
+	if !rw.debugStart.IsZero() && status >= 200 {
+		rw.Header().Set("X-Proxy-Duration-Ms", strconv.FormatInt(time.Since(rw.debugStart).Milliseconds(), 10))
+	}
 	rw.status = status
 	rw.ResponseWriter.WriteHeader(status)
 }
 
 func (rw *responseWriterWrapper) Write(b []byte) (int, error) {
 	if rw.status == 0 {
-		rw.status = http.StatusOK
+		rw.WriteHeader(http.StatusOK)
 	}
-	return rw.ResponseWriter.Write(b)
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the underlying writer so http.ResponseController can flush and hijack,
+// which streaming responses, trailers and protocol upgrades rely on
+func (rw *responseWriterWrapper) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
 }
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golangproxy/logger"
+)
+
+// clientHostKey carries the Host the client asked for to ModifyResponse, the Director may replace it
+type clientHostKey struct{}
+
+// checkRedirect refuses a Location pointing away from the client's host and the allowed hosts, so a
+// compromised target can't turn the site into an open redirect; relative redirects always pass
+func checkRedirect(resp *http.Response, allowed []string) error {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	// Browsers read backslashes as slashes, "/\evil.com" leads to evil.com
+	target, err := url.Parse(strings.ReplaceAll(location, `\`, "/"))
+	if err != nil {
+		return fmt.Errorf("target sent an invalid Location %q", location)
+	}
+	if target.Host == "" && target.Scheme == "" {
+		return nil
+	}
+	host := target.Hostname()
+	clientHost, _ := resp.Request.Context().Value(clientHostKey{}).(string)
+	if h, _, err := net.SplitHostPort(clientHost); err == nil {
+		clientHost = h
+	}
+	if strings.EqualFold(host, clientHost) || hostAllowed(host, allowed) {
+		return nil
+	}
+	logger.Logger.Printf("WARNING: blocked redirect from %s to disallowed host %q", clientHost, host)
+	return fmt.Errorf("target redirected to disallowed host %q", host)
+}
+
+// hostAllowed reports whether host is listed, "*.example.com" entries match any subdomain
+func hostAllowed(host string, allowed []string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range allowed {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if suffix, ok := strings.CutPrefix(entry, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == entry {
+			return true
+		}
+	}
+	return false
+}
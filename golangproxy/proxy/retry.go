@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"golangproxy/logger"
+)
+
+// retryWait is the pause before the first retry; each further retry waits one step longer
+const retryWait = 100 * time.Millisecond
+
+// retryTransport repeats idempotent requests without a body while the target answers with one
+// of the configured statuses (e.g., a 503 during scale-up), returning the last response
+type retryTransport struct {
+	base     http.RoundTripper
+	statuses []int // Statuses worth retrying
+	retries  int   // Retries after the first attempt
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := isIdempotent(req.Method) && (req.Body == nil || req.Body == http.NoBody)
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || !retryable || attempt >= t.retries || !slices.Contains(t.statuses, resp.StatusCode) {
+			return resp, err
+		}
+		logger.Logger.Printf("Retrying %s %s%s after status %d (retry %d of %d)", req.Method, req.Host, req.URL.Path, resp.StatusCode, attempt+1, t.retries)
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // Let the connection be reused
+		resp.Body.Close()
+		timer := time.NewTimer(retryWait * time.Duration(attempt+1))
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// isIdempotent reports whether repeating a request with this method is safe
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
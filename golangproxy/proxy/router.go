@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golangproxy/hostmatch"
+)
+
+// Router selects the route serving a request host
+type Router struct {
+	Routes       map[string]*Route        // Host-specific routes
+	Default      *Route                   // Wildcard route
+	FallbackHost string                   // Configured host whose route serves unmatched hosts instead of Default
+	HeaderRoutes map[string][]HeaderRoute // Header-matched routes per host, checked before Routes
+	LocalPaths   map[string]*Route        // Paths answered by the proxy for every host, never proxied
+	RequireSNI   bool                     // Answer 421 when the Host header differs from the TLS server name
+	ACME         *Route                   // Serves ACME HTTP-01 challenge files for every host, never proxied or redirected
+	DebugHeaders bool                     // Report the MatchKind of each request in X-Proxy-Route-Match
+	NoAbsolute   bool                     // Answer 400 to absolute-form requests ("GET http://host/path"), as a forward proxy would get
+}
+
+// How MatchKind found a request's route
+const (
+	MatchMisdirected = "misdirected" // Host differs from the TLS server name
+	MatchAbsolute    = "absolute"    // Absolute-form request refused with NoAbsolute
+	MatchACME        = "acme"        // ACME challenge path
+	MatchLocal       = "local"       // Local path answered by the proxy
+	MatchHeader      = "header"      // Header route
+	MatchExact       = "exact"       // Route for the host, with or without port
+	MatchWildcard    = "wildcard"    // Wildcard route such as "*.example.com"
+	MatchFallback    = "fallback"    // default_host_fallback route, or 404 when it has none
+	MatchDefault     = "default"     // '*' route
+)
+
+// HeaderRoute sends requests for a host to its own route when a request header matches
+type HeaderRoute struct {
+	Header string // Request header to inspect (e.g., "Accept")
+	Value  string // Case-insensitive substring the header must contain; empty only requires presence
+	Route  *Route // Route serving matching requests
+}
+
+// matches reports whether the request carries the header condition
+func (hr HeaderRoute) matches(req *http.Request) bool {
+	values := req.Header.Values(hr.Header)
+	if hr.Value == "" {
+		return len(values) > 0
+	}
+	want := strings.ToLower(hr.Value)
+	for _, value := range values {
+		if strings.Contains(strings.ToLower(value), want) {
+			return true
+		}
+	}
+	return false
+}
+
+// notConfiguredRoute answers requests for hosts the proxy has no route for
+var notConfiguredRoute = &Route{
+	Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("host %q is not configured", r.Host))
+	}),
+}
+
+// RejectTarget as the '*' route target rejects hosts without a route instead of proxying them
+const RejectTarget = "reject"
+
+// rejectedRoute answers requests for unmatched hosts when the '*' route is RejectTarget, so forged
+// Host headers never reach a catch-all backend
+var rejectedRoute = &Route{
+	Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusMisdirectedRequest, fmt.Sprintf("host %q is not served here", r.Host))
+	}),
+}
+
+// RejectRoute returns the route rejecting unmatched hosts with 421 Misdirected Request
+func RejectRoute() *Route {
+	return rejectedRoute
+}
+
+// misdirectedRoute answers TLS requests whose Host differs from the SNI server name; clients
+// that reused a connection for another host retry on a new one
+var misdirectedRoute = &Route{
+	Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusMisdirectedRequest, fmt.Sprintf("host %q does not match the TLS server name %q", r.Host, r.TLS.ServerName))
+	}),
+}
+
+// absoluteFormRoute answers absolute-form requests when they are refused
+var absoluteFormRoute = &Route{
+	Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusBadRequest, "absolute-form request targets are not accepted, this is not a forward proxy")
+	}),
+}
+
+// sniMismatch reports whether a TLS request names a different host than its handshake did;
+// plain HTTP and handshakes without SNI (clients connecting by IP) are not checked
+func sniMismatch(req *http.Request) bool {
+	if req.TLS == nil || req.TLS.ServerName == "" {
+		return false
+	}
+	host := hostmatch.Normalize(req.Host)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return host != hostmatch.Normalize(req.TLS.ServerName)
+}
+
+// LocalRoute creates a route answering requests itself with a fixed status and body
+func LocalRoute(status int, body string) *Route {
+	if status == 0 {
+		status = http.StatusNotFound
+	}
+	return &Route{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if body == "" {
+				writeError(w, r, status, strings.ToLower(http.StatusText(status)))
+				return
+			}
+			http.Error(w, body, status)
+		}),
+	}
+}
+
+// acmeChallengePath is where ACME clients place HTTP-01 challenge tokens (RFC 8555 8.3)
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// ACMERoute creates a route serving challenge token files written by an external ACME client
+// (e.g., certbot --webroot) from webroot/.well-known/acme-challenge
+func ACMERoute(webroot string) *Route {
+	dir := filepath.Join(webroot, filepath.FromSlash(acmeChallengePath))
+	return &Route{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+			// Tokens are base64url, anything else (including "..") never names a challenge file
+			if token == "" || strings.Trim(token, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+				writeError(w, r, http.StatusNotFound, "challenge not found")
+				return
+			}
+			body, err := os.ReadFile(filepath.Join(dir, token))
+			if err != nil {
+				writeError(w, r, http.StatusNotFound, "challenge not found")
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(body)
+		}),
+	}
+}
+
+// Match retrieves the route for a request, preferring ACME challenges, local paths and then header-matched routes for its host;
+// with RequireSNI, TLS requests for another host than the handshake named get a 421
+func (rt *Router) Match(req *http.Request) *Route {
+	route, _ := rt.MatchKind(req)
+	return route
+}
+
+// MatchKind is Match also reporting how the route was found (one of the Match* kinds)
+func (rt *Router) MatchKind(req *http.Request) (*Route, string) {
+	if rt.RequireSNI && sniMismatch(req) {
+		return misdirectedRoute, MatchMisdirected
+	}
+	// net/http already takes the host of an absolute-form target ("GET http://host/path") over the
+	// Host header and keeps only the path in req.URL.Path, so such requests route like any other
+	if rt.NoAbsolute && req.URL.IsAbs() {
+		return absoluteFormRoute, MatchAbsolute
+	}
+	// Challenge paths stay raw, the ACME route refuses tokens with dot-segments itself
+	if rt.ACME != nil && strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		return rt.ACME, MatchACME
+	}
+	// No ServeMux cleans the path first, "/x/../server-status" and "//server-status" must match as well
+	if route := rt.localPath(CleanPath(req.URL.Path)); route != nil {
+		return route, MatchLocal
+	}
+	for _, hr := range rt.HeaderRoutes[hostmatch.Normalize(req.Host)] {
+		if hr.matches(req) {
+			return hr.Route, MatchHeader
+		}
+	}
+	return rt.lookup(req.Host, listenerPort(req))
+}
+
+// listenerPort returns the port of the listener a request arrived on, empty when unknown
+func listenerPort(req *http.Request) string {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// Lookup retrieves the route for a host, using the fallback host or default route when unmatched;
+// the host is matched case-insensitively, with its port first, then without it, then against
+// wildcard routes such as "*.example.com"
+func (rt *Router) Lookup(host string) *Route {
+	route, _ := rt.lookup(host, "")
+	return route
+}
+
+// lookup is Lookup also reporting the match kind; a request that arrived on listenerPort also
+// matches "host:listenerPort" before the bare host, so one host can route differently per listener
+func (rt *Router) lookup(host, listenerPort string) (*Route, string) {
+	host = hostmatch.Normalize(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	// Most specific first: the port the client named, the listener port, then the bare host
+	var candidates []string
+	if host != hostname {
+		candidates = append(candidates, host)
+	}
+	if listenerPort != "" {
+		candidates = append(candidates, net.JoinHostPort(hostname, listenerPort))
+	}
+	candidates = append(candidates, hostname)
+	for _, key := range candidates {
+		if route, ok := rt.Routes[key]; ok {
+			return route, MatchExact
+		}
+	}
+	if route, ok := hostmatch.Wildcard(rt.Routes, hostname); ok {
+		return route, MatchWildcard
+	}
+	if rt.FallbackHost != "" {
+		if route, ok := rt.Routes[rt.FallbackHost]; ok {
+			return route, MatchFallback
+		}
+		return notConfiguredRoute, MatchFallback
+	}
+	return rt.Default, MatchDefault
+}
+
+// CleanPath resolves dot-segments and repeated slashes in a request path, keeping a trailing slash
+func CleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// localPath finds the local route for a request path: an exact match wins, otherwise the
+// longest configured path the request is under (e.g., "/server-status" covers "/server-status/x")
+func (rt *Router) localPath(path string) *Route {
+	if route, ok := rt.LocalPaths[path]; ok {
+		return route
+	}
+	var best *Route
+	bestLen := -1
+	for prefix, route := range rt.LocalPaths {
+		dir := strings.TrimSuffix(prefix, "/") + "/"
+		if strings.HasPrefix(path, dir) && len(dir) > bestLen {
+			best, bestLen = route, len(dir)
+		}
+	}
+	return best
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errRequestTimeout is the cause of a request canceled because request_timeout passed without response headers
+var errRequestTimeout = errors.New("upstream timed out")
+
+// responseTimerKey carries the request_timeout timer to ModifyResponse
+type responseTimerKey struct{}
+
+// responseTimeoutContext cancels ctx with errRequestTimeout unless the response headers reach
+// ModifyResponse (after any retries) within timeout; the body may then take as long as it needs
+func responseTimeoutContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(timeout, func() { cancel(errRequestTimeout) })
+	ctx = context.WithValue(ctx, responseTimerKey{}, timer)
+	return ctx, func() {
+		timer.Stop()
+		cancel(nil)
+	}
+}
+
+// stopResponseTimer lifts request_timeout once the response headers arrived, failing when it
+// fired just before
+func stopResponseTimer(resp *http.Response) error {
+	timer, ok := resp.Request.Context().Value(responseTimerKey{}).(*time.Timer)
+	if ok && !timer.Stop() {
+		return errRequestTimeout
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+)
+
+// defaultUpgradeTimeout limits the WebSocket handshake when a route sets no timeout
+const defaultUpgradeTimeout = 10 * time.Second
+
+// errUpgradeTimeout is the cause of a request canceled while waiting for the handshake answer
+var errUpgradeTimeout = errors.New("websocket handshake timed out")
+
+// isUpgrade reports whether a request asks to switch protocols (e.g., a WebSocket handshake)
+func isUpgrade(h http.Header) bool {
+	return headerHasToken(h, "Connection", "upgrade") && strings.TrimSpace(h.Get("Upgrade")) != ""
+}
+
+// handshakeContext cancels ctx with errUpgradeTimeout unless the target starts answering within
+// timeout; once the first response byte arrives the deadline is lifted so the tunnel can stay open
+func handshakeContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = defaultUpgradeTimeout
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(timeout, func() { cancel(errUpgradeTimeout) })
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{GotFirstResponseByte: func() { timer.Stop() }})
+	return ctx, func() {
+		timer.Stop()
+		cancel(nil)
+	}
+}
+
+// normalizeUpgrade reduces a WebSocket handshake's Upgrade header to "websocket" when the client
+// lists it among other tokens ("websocket, h2c") or with odd case and spacing; ReverseProxy forwards
+// the Upgrade value as is and refuses the target's 101 unless it names exactly that value
+func normalizeUpgrade(h http.Header) {
+	if !headerHasToken(h, "Connection", "upgrade") {
+		return
+	}
+	if headerHasToken(h, "Upgrade", "websocket") {
+		h.Set("Upgrade", "websocket")
+	}
+}
+
+// headerHasToken reports whether a comma-separated header contains token, ignoring case and spacing
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
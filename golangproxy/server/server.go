@@ -1,39 +1,100 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
+	"html/template"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golangproxy/logger"
 )
 
-// StartServer launches a web server on 127.0.0.1:61147
-func StartServer() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// Version is shown on the landing page, set at build time with -ldflags "-X golangproxy/server.Version=..."
+var Version = "dev"
+
+// PageData holds the variables available to landing page templates
+type PageData struct {
+	Version string        // Proxy version
+	Uptime  time.Duration // Time since the web server started
+	Hosts   []string      // Configured hostnames, sorted
+}
+
+// defaultLanding is rendered when no landing_template is configured or it can't be used
+var defaultLanding = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>GoLangProxy</title></head>
+<body>
+<h1>GoLangProxy is up</h1>
+<p>Version {{.Version}}, running for {{.Uptime}}</p>
+</body>
+</html>
+`))
+
+// Landing page state, replaced by SetLanding on config reloads
+var (
+	landingMutex sync.RWMutex
+	landing      = defaultLanding
+	landingHosts []string
+	started      = time.Now()
+)
+
+// SetLanding sets the landing page template file (empty for the built-in page) and the hostnames
+// it can list; an invalid template is logged and the built-in page is used instead
+func SetLanding(templatePath string, hosts []string) {
+	tmpl := defaultLanding
+	if templatePath != "" {
+		parsed, err := template.ParseFiles(templatePath)
+		if err != nil {
+			logger.Logger.Printf("Error parsing landing_template, using the built-in page: %v", err)
+		} else {
+			tmpl = parsed
+		}
+	}
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+	landingMutex.Lock()
+	landing, landingHosts = tmpl, sorted
+	landingMutex.Unlock()
+}
+
+// Handler serves www/index.html if it exists and the landing page template otherwise; the file is
+// never created, a static copy would hide the landing page for good
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		indexPath := filepath.Join("www", "index.html")
-		if _, err := os.Stat(indexPath); os.IsNotExist(err) {
-			// Create index.html if it doesn’t exist
-			if err := os.MkdirAll("www", 0755); err != nil {
-				http.Error(w, "Error creating www directory", http.StatusInternalServerError)
-				return
-			}
-			file, err := os.Create(indexPath)
-			if err != nil {
-				http.Error(w, "Error creating index.html", http.StatusInternalServerError)
-				return
-			}
-			defer file.Close()
-			_, err = file.WriteString("<h1>GoLangProxy is up</h1>")
-			if err != nil {
-				http.Error(w, "Error writing index.html", http.StatusInternalServerError)
-				return
-			}
+		if _, err := os.Stat(indexPath); err == nil {
+			http.ServeFile(w, r, indexPath)
+			return
 		}
-		http.ServeFile(w, r, indexPath)
+		landingMutex.RLock()
+		tmpl, hosts := landing, landingHosts
+		landingMutex.RUnlock()
+		data := PageData{Version: Version, Uptime: time.Since(started).Round(time.Second), Hosts: hosts}
+		var page bytes.Buffer
+		if err := tmpl.Execute(&page, data); err != nil {
+			logger.Logger.Printf("Error rendering landing_template, using the built-in page: %v", err)
+			page.Reset()
+			defaultLanding.Execute(&page, data)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page.Bytes())
 	})
+}
 
+// StartServer launches a web server on 127.0.0.1:61147
+func StartServer(readHeaderTimeout time.Duration) {
 	fmt.Println("Starting simple web server on 127.0.0.1:61147")
-	if err := http.ListenAndServe("127.0.0.1:61147", nil); err != nil {
+	srv := &http.Server{
+		Addr:              "127.0.0.1:61147",
+		Handler:           Handler(),
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	if err := srv.ListenAndServe(); err != nil {
 		fmt.Println("Web server error:", err)
 	}
 }
@@ -0,0 +1,74 @@
+package ssl
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+
+	"golangproxy/config"
+	"golangproxy/hostmatch"
+	"golangproxy/logger"
+)
+
+// CertStore holds the HTTPS certificates: the default one and those of cert_map, picked by the
+// server name the client asks for with the same exact and wildcard matching as routes
+type CertStore struct {
+	mu    sync.RWMutex
+	def   *tls.Certificate            // cert_file, served when no cert_map host matches
+	hosts map[string]*tls.Certificate // cert_map certificates by normalized host
+}
+
+// NewCertStore creates an empty CertStore; Load it before serving
+func NewCertStore() *CertStore {
+	return &CertStore{hosts: make(map[string]*tls.Certificate)}
+}
+
+// Load reads the default keypair and every cert_map keypair. When the default fails nothing is
+// replaced; a cert_map host that fails keeps its last loaded certificate, or gets the default
+func (s *CertStore) Load(certFile, keyFile string, certMap map[string]config.CertPair) error {
+	def, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	previous := s.hosts
+	s.mu.RUnlock()
+
+	hosts := make(map[string]*tls.Certificate, len(certMap))
+	for host, pair := range certMap {
+		host = hostmatch.Normalize(host)
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			logger.Logger.Printf("Error loading certificate for %s: %v", host, err)
+			if last, ok := previous[host]; ok {
+				hosts[host] = last
+			}
+			continue
+		}
+		hosts[host] = &cert
+	}
+
+	s.mu.Lock()
+	s.def, s.hosts = &def, hosts
+	s.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is the tls.Config callback choosing the certificate for a ClientHello
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if hello.ServerName != "" {
+		name := hostmatch.Normalize(hello.ServerName)
+		if cert, ok := s.hosts[name]; ok {
+			return cert, nil
+		}
+		if cert, ok := hostmatch.Wildcard(s.hosts, name); ok {
+			return cert, nil
+		}
+	}
+	if s.def == nil {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+	return s.def, nil
+}
@@ -0,0 +1,129 @@
+package ssl
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golangproxy/logger"
+)
+
+// Handshake failure log limits: at most handshakeLogBurst lines per handshakeLogWindow, the rest are counted
+const (
+	handshakeLogBurst  = 10
+	handshakeLogWindow = time.Second
+	helloTTL           = time.Minute // Hellos of connections that never finish are forgotten after this
+)
+
+// HandshakeLog is the HTTPS server's error log. net/http logs failed TLS handshakes with only the
+// client address and the error, so the server name and versions the client offered are remembered
+// from its ClientHello and added to those lines, which are rate limited so scanners can't flood the log
+type HandshakeLog struct {
+	mu         sync.Mutex
+	hellos     map[string]hello // Offered handshakes by client address, removed once the connection is in use
+	window     time.Time        // Start of the current rate limit window
+	logged     int              // Handshake lines logged in the window
+	suppressed int              // Handshake lines dropped since the last one logged
+}
+
+// hello is what a client offered in its ClientHello
+type hello struct {
+	serverName string
+	versions   []uint16
+	seen       time.Time
+}
+
+// NewHandshakeLog creates a HandshakeLog
+func NewHandshakeLog() *HandshakeLog {
+	return &HandshakeLog{hellos: make(map[string]hello)}
+}
+
+// Attach makes srv report failed TLS handshakes through h: every ClientHello is remembered until
+// the connection carries a request or closes, and srv's error log is written to h
+func (h *HandshakeLog) Attach(srv *http.Server) {
+	srv.TLSConfig.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		h.remember(info.Conn.RemoteAddr().String(), hello{serverName: info.ServerName, versions: info.SupportedVersions, seen: time.Now()})
+		return nil, nil
+	}
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateActive, http.StateHijacked, http.StateClosed:
+			h.forget(conn.RemoteAddr().String())
+		}
+	}
+	srv.ErrorLog = log.New(h, "", 0)
+}
+
+func (h *HandshakeLog) remember(addr string, offered hello) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, old := range h.hellos {
+		if time.Since(old.seen) > helloTTL {
+			delete(h.hellos, key)
+		}
+	}
+	h.hellos[addr] = offered
+}
+
+func (h *HandshakeLog) forget(addr string) {
+	h.mu.Lock()
+	delete(h.hellos, addr)
+	h.mu.Unlock()
+}
+
+// Write passes server errors to the proxy log, adding the offered handshake to TLS handshake errors
+func (h *HandshakeLog) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	const marker = "TLS handshake error from "
+	i := strings.Index(line, marker)
+	if i < 0 {
+		logger.Logger.Print(line)
+		return len(p), nil
+	}
+	addr, _, _ := strings.Cut(line[i+len(marker):], ": ")
+
+	h.mu.Lock()
+	offered, ok := h.hellos[addr]
+	delete(h.hellos, addr)
+	now := time.Now()
+	if now.Sub(h.window) >= handshakeLogWindow {
+		h.window, h.logged = now, 0
+	}
+	if h.logged >= handshakeLogBurst {
+		h.suppressed++
+		h.mu.Unlock()
+		return len(p), nil
+	}
+	h.logged++
+	suppressed := h.suppressed
+	h.suppressed = 0
+	h.mu.Unlock()
+
+	if ok {
+		line += fmt.Sprintf(" (sni=%q offered=%s)", offered.serverName, versionNames(offered.versions))
+	} else {
+		line += " (no ClientHello received)"
+	}
+	if suppressed > 0 {
+		line += fmt.Sprintf(" [%d more handshake errors not logged]", suppressed)
+	}
+	logger.Logger.Print(line)
+	return len(p), nil
+}
+
+// versionNames lists TLS versions by name, e.g. "TLS 1.3,TLS 1.2"
+func versionNames(versions []uint16) string {
+	if len(versions) == 0 {
+		return "none"
+	}
+	names := make([]string, len(versions))
+	for i, v := range versions {
+		names[i] = tls.VersionName(v)
+	}
+	return strings.Join(names, ",")
+}
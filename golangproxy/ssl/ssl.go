@@ -1,33 +1,169 @@
 package ssl
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"golangproxy/logger"
 )
 
-// EnsureCertFiles ensures SSL certificate and key files exist, generating self-signed if needed
-func EnsureCertFiles(certPath, keyPath string) error {
+// selfSignedOrg marks certificates generated by the proxy, only those are ever renewed
+const selfSignedOrg = "GoLangProxy Self-Signed"
+
+// CertValidity is how long generated self-signed certificates are valid
+var CertValidity = 365 * 24 * time.Hour
+
+// defaultDNSNames are the SANs of a newly generated self-signed certificate
+var defaultDNSNames = []string{"example.com", "localhost"}
+
+// Key types for generated certificates
+const (
+	KeyTypeRSA   = "rsa"
+	KeyTypeECDSA = "ecdsa"
+)
+
+// Key generated for self-signed certificates, changed with SetKeyType
+var (
+	keyType = KeyTypeRSA
+	keyBits = 2048
+)
+
+// ecdsaCurves maps the accepted ECDSA key sizes to their curves
+var ecdsaCurves = map[int]elliptic.Curve{
+	256: elliptic.P256(),
+	384: elliptic.P384(),
+}
+
+// SetKeyType chooses the key of generated certificates (cert_key_type and cert_key_bits): rsa with
+// 2048 (default), 3072 or 4096 bits, or ecdsa with 256 (P-256, default) or 384 (P-384) bits.
+// Anything else logs a warning and uses RSA-2048
+func SetKeyType(kind string, bits int) {
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	switch kind {
+	case "", KeyTypeRSA:
+		if bits == 0 {
+			bits = 2048
+		}
+		if bits == 2048 || bits == 3072 || bits == 4096 {
+			keyType, keyBits = KeyTypeRSA, bits
+			return
+		}
+	case KeyTypeECDSA:
+		if bits == 0 {
+			bits = 256
+		}
+		if _, ok := ecdsaCurves[bits]; ok {
+			keyType, keyBits = KeyTypeECDSA, bits
+			return
+		}
+	}
+	logger.Logger.Printf("WARNING: unsupported cert_key_type %q with cert_key_bits %d, generating RSA-2048 keys", kind, bits)
+	keyType, keyBits = KeyTypeRSA, 2048
+}
+
+// generateKey creates a private key of the configured type and its PEM block
+func generateKey() (crypto.Signer, *pem.Block, error) {
+	if keyType == KeyTypeECDSA {
+		priv, err := ecdsa.GenerateKey(ecdsaCurves[keyBits], rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Logger.Printf("Generated ECDSA P-%d private key", keyBits)
+		return priv, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := priv.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("generated private key is invalid: %w", err)
+	}
+	logger.Logger.Printf("Generated and validated %d-bit RSA private key", keyBits)
+	return priv, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}, nil
+}
+
+// EnsureCertFiles ensures SSL certificate and key files exist, generating a self-signed one for hosts
+// (the route hosts: names, "*.example.com" wildcards and IP literals) if needed
+func EnsureCertFiles(certPath, keyPath string, hosts ...string) error {
 	_, certErr := os.Stat(certPath)
 	_, keyErr := os.Stat(keyPath)
 	if os.IsNotExist(certErr) || os.IsNotExist(keyErr) {
 		logger.Logger.Printf("Certificate or key missing, generating new ones: %s, %s", certPath, keyPath)
-		return generateSelfSignedCert(certPath, keyPath)
+		return generateSelfSignedCert(certPath, keyPath, certNames(hosts))
 	}
 	logger.Logger.Printf("Certificate and key found: %s, %s", certPath, keyPath)
 	return nil
 }
 
-// generateSelfSignedCert creates a self-signed certificate and key
-func generateSelfSignedCert(certPath, keyPath string) error {
+// RenewSelfSigned regenerates a self-signed certificate generated by the proxy once it expires within
+// window, named after the current route hosts like EnsureCertFiles; provided certificates are never
+// touched. It reports whether it renewed
+func RenewSelfSigned(certPath, keyPath string, window time.Duration, hosts ...string) (bool, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return false, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return false, fmt.Errorf("no PEM certificate in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false, err
+	}
+	if !slices.Contains(cert.Subject.Organization, selfSignedOrg) || cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) != nil {
+		return false, nil
+	}
+	if time.Until(cert.NotAfter) > window {
+		return false, nil
+	}
+	logger.Logger.Printf("Self-signed certificate %s expires %s, generating a new one", certPath, cert.NotAfter.Format(time.RFC3339))
+	return true, generateSelfSignedCert(certPath, keyPath, certNames(hosts))
+}
+
+// certNames turns route hosts into certificate names: ports and the '*' route are dropped,
+// duplicates removed; without any host the defaults are used
+func certNames(hosts []string) []string {
+	var names []string
+	for _, host := range hosts {
+		host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" || host == "*" || slices.Contains(names, host) {
+			continue
+		}
+		names = append(names, host)
+	}
+	if len(names) == 0 {
+		return defaultDNSNames
+	}
+	slices.Sort(names)
+	return names
+}
+
+// generateSelfSignedCert creates a self-signed certificate and key for names, IP literals become
+// IP SANs and the first name that isn't an IP or wildcard is the CommonName
+func generateSelfSignedCert(certPath, keyPath string, names []string) error {
 	// Ensure ssl directory exists
 	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
 		logger.Logger.Printf("Error creating ssl directory: %v", err)
@@ -36,35 +172,51 @@ func generateSelfSignedCert(certPath, keyPath string) error {
 	logger.Logger.Println("Created ssl directory")
 
 	// Generate private key
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	priv, keyBlock, err := generateKey()
 	if err != nil {
 		logger.Logger.Printf("Error generating private key: %v", err)
 		return err
 	}
-	if err := priv.Validate(); err != nil {
-		logger.Logger.Printf("Generated private key is invalid: %v", err)
+
+	// A random serial, browsers refuse a renewed certificate reusing issuer and serial with another key
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		logger.Logger.Printf("Error generating serial number: %v", err)
 		return err
 	}
-	logger.Logger.Println("Generated and validated 2048-bit RSA private key")
 
 	// Create certificate template
 	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+		SerialNumber: serial,
 		Subject: pkix.Name{
-			Organization: []string{"GoLangProxy Self-Signed"},
-			CommonName:   "example.com",
+			Organization: []string{selfSignedOrg},
 		},
 		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		NotAfter:              time.Now().Add(CertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		DNSNames:              []string{"example.com", "localhost"}, // SANs required
 	}
-	logger.Logger.Printf("Created certificate template with CN=%s, DNSNames=%v", template.Subject.CommonName, template.DNSNames)
+	for _, name := range names { // SANs required
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+			continue
+		}
+		template.DNSNames = append(template.DNSNames, name)
+		if template.Subject.CommonName == "" && !strings.HasPrefix(name, "*.") {
+			template.Subject.CommonName = name
+		}
+	}
+	if template.Subject.CommonName == "" {
+		template.Subject.CommonName = names[0]
+	}
+	if keyType == KeyTypeRSA {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment // RSA key exchange, ECDSA keys only sign
+	}
+	logger.Logger.Printf("Created certificate template with CN=%s, DNSNames=%v, IPAddresses=%v", template.Subject.CommonName, template.DNSNames, template.IPAddresses)
 
 	// Generate certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
 	if err != nil {
 		logger.Logger.Printf("Error creating certificate: %v", err)
 		return err
@@ -91,7 +243,7 @@ func generateSelfSignedCert(certPath, keyPath string) error {
 		return err
 	}
 	defer keyOut.Close()
-	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}); err != nil {
+	if err := pem.Encode(keyOut, keyBlock); err != nil {
 		logger.Logger.Printf("Error encoding key PEM: %v", err)
 		return err
 	}
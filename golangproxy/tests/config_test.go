@@ -1,8 +1,17 @@
 package tests
 
 import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golangproxy/config"
 )
@@ -19,3 +28,245 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("Expected ListenHTTP :80, got %s", config.ListenHTTP)
 	}
 }
+
+func TestReadHeaderTimeoutCutsOffSlowClient(t *testing.T) {
+	cfg := &config.Config{ReadHeaderTimeout: 1}
+	if cfg.ReadHeaderTimeoutDuration() != time.Second {
+		t.Fatalf("Expected 1s timeout, got %v", cfg.ReadHeaderTimeoutDuration())
+	}
+	if (&config.Config{}).ReadHeaderTimeoutDuration() != config.DefaultReadHeaderTimeout*time.Second {
+		t.Error("Expected default timeout when read_header_timeout is unset")
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ReadHeaderTimeout = cfg.ReadHeaderTimeoutDuration()
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %v", err)
+	}
+	defer conn.Close()
+
+	// Send the request line and then stall like a slowloris client
+	start := time.Now()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n")); err != nil {
+		t.Fatalf("Error writing partial headers: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Log("Server answered the incomplete request before closing")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected slow client to be cut off after ~1s, took %v", elapsed)
+	}
+}
+
+func TestTLSCurvesValidatedAtLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("routes:\n  '*': http://127.0.0.1:80\ntls_curves: [X25519, P-256]\ntls_session_tickets: false\n"), 0644)
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Error loading config with valid curves: %v", err)
+	}
+	curves, _ := cfg.CurvePreferences()
+	if len(curves) != 2 || curves[0] != tls.X25519 || curves[1] != tls.CurveP256 {
+		t.Errorf("Expected [X25519 P-256], got %v", curves)
+	}
+	if cfg.SessionTicketsEnabled() {
+		t.Error("Expected session tickets to be disabled")
+	}
+
+	os.WriteFile(path, []byte("routes:\n  '*': http://127.0.0.1:80\ntls_curves: [P-192]\n"), 0644)
+	if _, err := config.LoadConfig(path); err == nil {
+		t.Error("Expected unsupported curve to be rejected at load")
+	}
+}
+
+func TestLocalPathsRootRejectedAtLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	for _, entry := range []string{"''", "/", "//", "/.", "/x/.."} {
+		os.WriteFile(path, []byte("routes:\n  '*': http://127.0.0.1:80\nlocal_paths:\n  - path: "+entry+"\n"), 0644)
+		if _, err := config.LoadConfig(path); err == nil {
+			t.Errorf("Expected local_paths entry %s to be rejected, it answers every request", entry)
+		}
+	}
+	os.WriteFile(path, []byte("routes:\n  '*': http://127.0.0.1:80\nlocal_paths:\n  - path: /server-status\n"), 0644)
+	if _, err := config.LoadConfig(path); err != nil {
+		t.Errorf("Expected a normal local path to load: %v", err)
+	}
+}
+
+func TestLoadConfigNoGenerate(t *testing.T) {
+	config.GenerateDefaults = false
+	defer func() { config.GenerateDefaults = true }()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if _, err := config.LoadConfig(path); err == nil {
+		t.Error("Expected an error for a missing config when generating defaults is disabled")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected no default config to be written")
+	}
+}
+
+func TestLoadConfigNormalizesHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "routes:\n  App.Example.COM: http://127.0.0.1:8080\ntrust_target:\n  App.Example.COM: true\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	if cfg.Routes["app.example.com"] == "" || !cfg.TrustTarget["app.example.com"] {
+		t.Errorf("Expected host keys to be lowercased, got %v and %v", cfg.Routes, cfg.TrustTarget)
+	}
+}
+
+func TestWatcherFallsBackToPolling(t *testing.T) {
+	defer func(interval time.Duration) { config.PollInterval = interval }(config.PollInterval)
+	config.PollInterval = 20 * time.Millisecond
+
+	dir := t.TempDir()
+	watched := filepath.Join(dir, "config.yaml")
+	os.WriteFile(watched, []byte("a"), 0644)
+	// fsnotify can't add a file that doesn't exist yet, just like when the inotify limit is reached
+	missing := filepath.Join(dir, "cert.pem")
+
+	watcher := config.NewWatcher()
+	defer watcher.Close()
+	watcher.Add(watched)
+	watcher.Add(missing)
+	if watcher.Polling(watched) || !watcher.Polling(missing) {
+		t.Fatalf("Expected only the file fsnotify couldn't watch to be polled")
+	}
+
+	for _, path := range []string{watched, missing} {
+		os.WriteFile(path, []byte("changed"), 0644)
+		select {
+		case name := <-watcher.Events:
+			if name != path {
+				t.Errorf("Expected a change to %s, got %s", path, name)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No change reported for %s", path)
+		}
+		// Drain duplicate events (a write can show up as several)
+		for drained := false; !drained; {
+			select {
+			case <-watcher.Events:
+			case <-time.After(100 * time.Millisecond):
+				drained = true
+			}
+		}
+	}
+}
+
+func TestWatcherSurvivesDeletedFile(t *testing.T) {
+	defer func(interval time.Duration) { config.PollInterval = interval }(config.PollInterval)
+	config.PollInterval = 20 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("a"), 0644)
+	watcher := config.NewWatcher()
+	defer watcher.Close()
+	watcher.Add(path)
+
+	waitFor := func(what string) {
+		t.Helper()
+		select {
+		case name := <-watcher.Events:
+			if name != path {
+				t.Errorf("Expected %s to be reported for %s, got %s", what, path, name)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No event for %s", what)
+		}
+		for drained := false; !drained; {
+			select {
+			case <-watcher.Events:
+			case <-time.After(100 * time.Millisecond):
+				drained = true
+			}
+		}
+	}
+
+	os.Remove(path)
+	waitFor("the deletion")
+	if !watcher.Polling(path) {
+		t.Fatalf("Expected the deleted file to be polled until it is back")
+	}
+
+	os.WriteFile(path, []byte("restored"), 0644)
+	waitFor("the restored file")
+	if watcher.Polling(path) {
+		t.Errorf("Expected the restored file to be watched with fsnotify again")
+	}
+	os.WriteFile(path, []byte("edited again"), 0644)
+	waitFor("a write after the restore")
+}
+
+func TestIdleTimeoutDefault(t *testing.T) {
+	tests := []struct {
+		cfg  config.Config
+		want time.Duration
+	}{
+		{config.Config{}, 0},
+		{config.Config{MaxConnections: 100}, config.DefaultIdleTimeout},
+		{config.Config{MaxConnections: 100, IdleTimeout: 15}, 15 * time.Second},
+		{config.Config{IdleTimeout: 30}, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.IdleTimeoutDuration(); got != tt.want {
+			t.Errorf("max_connections %d, idle_timeout %d: expected %s, got %s", tt.cfg.MaxConnections, tt.cfg.IdleTimeout, tt.want, got)
+		}
+	}
+}
+
+func TestReloaderCoalescesAndSerializes(t *testing.T) {
+	// Requests fired while a reload runs collapse into a single follow-up run, and runs
+	// never overlap; run with -race to catch unsynchronized state
+	var runs, active, overlaps atomic.Int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	reloader := config.NewReloader(func() {
+		if active.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		if runs.Add(1) == 1 {
+			started <- struct{}{}
+			<-release
+		}
+		active.Add(-1)
+	})
+	done := make(chan struct{})
+	go func() {
+		reloader.Run()
+		close(done)
+	}()
+
+	reloader.Request()
+	<-started
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reloader.Request()
+		}()
+	}
+	wg.Wait()
+	reloader.Close()
+	close(release)
+	<-done
+
+	if n := runs.Load(); n != 2 {
+		t.Errorf("Expected 101 requests to coalesce into 2 reloads, got %d", n)
+	}
+	if n := overlaps.Load(); n != 0 {
+		t.Errorf("Expected reloads to run one at a time, %d overlapped", n)
+	}
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golangproxy/logger"
+	"golangproxy/proxy"
+)
+
+func TestLoggerFallsBackToStdoutWhenLogsUnwritable(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// A regular file named "logs" makes the logs directory impossible to create
+	if err := os.WriteFile("logs", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err := logger.Configure([]string{logger.OutputFile})
+	logger.Logger.Println("still logging")
+	os.Stdout = stdout
+	w.Close()
+	var out bytes.Buffer
+	io.Copy(&out, r)
+	logger.Logger.SetOutput(os.Stdout)
+
+	if err != nil {
+		t.Fatalf("Expected unwritable logs directory to be non-fatal, got %v", err)
+	}
+	if !strings.Contains(out.String(), "file logging disabled") || !strings.Contains(out.String(), "still logging") {
+		t.Errorf("Expected warning and log lines on stdout, got %q", out.String())
+	}
+}
+
+func TestAccessLogSeparateFromProxyLog(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := logger.Configure([]string{logger.OutputFile}); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Logger.SetOutput(os.Stdout)
+	if err := logger.EnableAccessLog(); err != nil {
+		t.Fatalf("Error enabling access log: %v", err)
+	}
+	defer logger.DisableAccessLog()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{AccessLog: true})
+	req := httptest.NewRequest("GET", "/page?x=1", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	route.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	access, _ := os.ReadFile(filepath.Join("logs", "access-"+time.Now().Format("2006-01-02")+".log"))
+	if !strings.Contains(string(access), `"GET /page?x=1 HTTP/1.1" 200 5 "-" "test-agent"`) {
+		t.Errorf("Expected combined access line, got %q", access)
+	}
+	proxyLog, _ := os.ReadFile(filepath.Join("logs", "proxy.log"))
+	if strings.Contains(string(proxyLog), "/page?x=1") {
+		t.Errorf("Expected access line to stay out of proxy.log, got %q", proxyLog)
+	}
+}
+
+func TestLogTimeFormat(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := logger.Configure([]string{logger.OutputFile}); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.SetTimeFormat("rfc3339", "utc"); err != nil {
+		t.Fatalf("Error setting time format: %v", err)
+	}
+	logger.Logger.Println("formatted")
+	logger.SetTimeFormat("", "")
+	logger.Logger.SetOutput(os.Stdout)
+
+	data, _ := os.ReadFile(filepath.Join("logs", "proxy.log"))
+	stamp, rest, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	parsed, err := time.Parse(time.RFC3339, stamp)
+	if err != nil || rest != "formatted" {
+		t.Fatalf("Expected RFC3339 timestamp prefix, got %q", data)
+	}
+	if !strings.HasSuffix(stamp, "Z") || time.Since(parsed) > time.Minute {
+		t.Errorf("Expected a current UTC timestamp, got %s", stamp)
+	}
+	if err := logger.SetTimeFormat("rfc3339", "mars"); err == nil {
+		t.Error("Expected unknown timezone to be rejected")
+	}
+}
+
+func TestLogOutputReconfigure(t *testing.T) {
+	// Config reloads call Configure again: a bad list keeps the current outputs, a good one replaces them
+	t.Chdir(t.TempDir())
+	if err := logger.Configure([]string{logger.OutputFile}); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Logger.SetOutput(os.Stdout)
+	if err := logger.Configure([]string{logger.OutputFile, "carrier-pigeon"}); err == nil {
+		t.Error("Expected unknown log output to be rejected")
+	}
+	logger.Logger.Println("kept")
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err := logger.Configure([]string{logger.OutputStdout})
+	logger.Logger.Println("moved")
+	os.Stdout = stdout
+	w.Close()
+	var out bytes.Buffer
+	io.Copy(&out, r)
+	if err != nil {
+		t.Fatalf("Error switching to stdout: %v", err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join("logs", "proxy.log"))
+	if !strings.Contains(string(data), "kept") || strings.Contains(string(data), "moved") {
+		t.Errorf("Expected the file to keep logging until the switch to stdout, got %q", data)
+	}
+	if !strings.Contains(out.String(), "moved") {
+		t.Errorf("Expected logging on stdout after the switch, got %q", out.String())
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := logger.EnableAccessLog(); err != nil {
+		t.Fatalf("Error enabling access log: %v", err)
+	}
+	defer logger.DisableAccessLog()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{AccessLog: true, AccessLogSample: 10})
+	for i := 0; i < 100; i++ {
+		route.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+	}
+	for i := 0; i < 5; i++ {
+		route.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/broken", nil))
+	}
+
+	access, _ := os.ReadFile(filepath.Join("logs", "access-"+time.Now().Format("2006-01-02")+".log"))
+	if n := strings.Count(string(access), "GET /ok "); n != 10 {
+		t.Errorf("Expected 1 in 10 successful requests logged, got %d of 100", n)
+	}
+	if n := strings.Count(string(access), "GET /broken "); n != 5 {
+		t.Errorf("Expected every error logged, got %d of 5", n)
+	}
+}
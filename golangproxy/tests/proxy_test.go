@@ -1,9 +1,32 @@
 package tests
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"golangproxy/logger"
 	"golangproxy/proxy"
+	"golangproxy/ssl"
 )
 
 func TestCreateRoute(t *testing.T) {
@@ -13,3 +36,1724 @@ func TestCreateRoute(t *testing.T) {
 		t.Errorf("Expected target http://example.com, got %s", route.Target)
 	}
 }
+
+func TestUpstreamProxyIsUsed(t *testing.T) {
+	var proxiedHost string
+	forwardProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy receives absolute-form requests for plain HTTP targets
+		proxiedHost = r.URL.Host
+		w.Write([]byte("via proxy"))
+	}))
+	defer forwardProxy.Close()
+
+	route := proxy.CreateRouteWithOptions("http://backend.invalid:8080", proxy.RouteOptions{UpstreamProxy: forwardProxy.URL})
+	rec := httptest.NewRecorder()
+	route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://app.example.com/", nil))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "via proxy" {
+		t.Fatalf("Expected response from upstream proxy, got %d %q", rec.Code, rec.Body.String())
+	}
+	if proxiedHost != "backend.invalid:8080" {
+		t.Errorf("Expected proxy to be asked for backend.invalid:8080, got %q", proxiedHost)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	for _, answer := range []bool{false, true} {
+		var gotExpect, gotBody string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotExpect = r.Header.Get("Expect")
+			// Reading the body makes the server send "100 Continue" before the 200
+			body, _ := io.ReadAll(r.Body)
+			gotBody = string(body)
+			w.WriteHeader(http.StatusOK)
+		}))
+		route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{AnswerExpectContinue: answer})
+		front := httptest.NewServer(route.Handler)
+
+		client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+		req, _ := http.NewRequest("POST", front.URL, strings.NewReader("upload"))
+		req.Header.Set("Expect", "100-continue")
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("answer=%t: request failed: %v", answer, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || gotBody != "upload" {
+			t.Errorf("answer=%t: expected 200 with body relayed, got %d %q", answer, resp.StatusCode, gotBody)
+		}
+		if time.Since(start) > 3*time.Second {
+			t.Errorf("answer=%t: client waited for the expect timeout instead of receiving 100 Continue", answer)
+		}
+		if answer == (gotExpect != "") {
+			t.Errorf("answer=%t: unexpected Expect header at backend: %q", answer, gotExpect)
+		}
+		front.Close()
+		backend.Close()
+	}
+}
+
+func TestOptionsMode(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "yes")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		mode    string
+		status  int
+		backend bool
+	}{
+		{proxy.OptionsPass, http.StatusOK, true},
+		{proxy.OptionsRespond, http.StatusNoContent, false},
+		{proxy.OptionsReject, http.StatusMethodNotAllowed, false},
+	}
+	for _, tt := range tests {
+		route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{OptionsMode: tt.mode})
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "http://app.example.com/api", nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.mode, tt.status, rec.Code)
+		}
+		if (rec.Header().Get("X-Backend") != "") != tt.backend {
+			t.Errorf("%s: expected backend reached=%t", tt.mode, tt.backend)
+		}
+		if !tt.backend && rec.Header().Get("Allow") == "" {
+			t.Errorf("%s: expected an Allow header", tt.mode)
+		}
+	}
+}
+
+func TestLogUpstreamTiming(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	var buf bytes.Buffer
+	logger.Logger.SetOutput(&buf)
+	defer logger.Logger.SetOutput(os.Stdout)
+
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{LogTiming: true})
+	route.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://app.example.com/slow", nil))
+
+	fields := map[string]float64{}
+	for _, field := range strings.Fields(buf.String()) {
+		if key, value, ok := strings.Cut(field, "="); ok && strings.HasSuffix(key, "_ms") {
+			fields[key], _ = strconv.ParseFloat(value, 64)
+		}
+	}
+	for _, key := range []string{"upstream_ttfb_ms", "upstream_total_ms", "proxy_overhead_ms", "total_ms"} {
+		if _, ok := fields[key]; !ok {
+			t.Fatalf("Expected %s in timing log, got %q", key, buf.String())
+		}
+	}
+	if fields["upstream_ttfb_ms"] < 20 || fields["upstream_ttfb_ms"] > fields["upstream_total_ms"] || fields["upstream_total_ms"] > fields["total_ms"] {
+		t.Errorf("Expected 20ms <= ttfb <= upstream total <= total, got %v", fields)
+	}
+}
+
+func TestReuseOrCreateKeepsUnchangedRoutes(t *testing.T) {
+	opts := proxy.RouteOptions{TrustInvalidCert: true}
+	route := proxy.CreateRouteWithOptions("https://10.0.0.1:4444", opts)
+
+	if got := proxy.ReuseOrCreate(route, "https://10.0.0.1:4444", opts); got != route {
+		t.Error("Expected unchanged route to be reused across reload")
+	}
+	if got := proxy.ReuseOrCreate(route, "https://10.0.0.2:4444", opts); got == route {
+		t.Error("Expected a new route when the target changes")
+	}
+	if got := proxy.ReuseOrCreate(route, "https://10.0.0.1:4444", proxy.RouteOptions{NoHTTPSRedirect: true, TrustInvalidCert: true}); got == route || !got.NoHTTPSRedirect {
+		t.Error("Expected a new route when options change")
+	}
+	if got := proxy.ReuseOrCreate(nil, "https://10.0.0.1:4444", opts); got == nil {
+		t.Error("Expected a route to be created for a new host")
+	}
+}
+
+func TestUpstreamH2C(t *testing.T) {
+	var backendProto int
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendProto = r.ProtoMajor
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("streamed"))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetHTTP1(true)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{UpstreamH2C: true})
+	front := httptest.NewServer(route.Handler)
+	defer front.Close()
+
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if backendProto != 2 {
+		t.Errorf("Expected HTTP/2 to the backend, got HTTP/%d", backendProto)
+	}
+	if string(body) != "streamed" || resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("Expected body and trailer relayed, got %q trailer %v", body, resp.Trailer)
+	}
+}
+
+func TestDisableKeepAlive(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		var conns atomic.Int32
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		backend.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		}
+		backend.Start()
+
+		route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{DisableKeepAlive: disable})
+		for i := 0; i < 3; i++ {
+			route.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://app.example.com/", nil))
+		}
+		backend.Close()
+
+		want := int32(1)
+		if disable {
+			want = 3
+		}
+		if got := conns.Load(); got != want {
+			t.Errorf("disable_keepalive=%t: expected %d upstream connections, got %d", disable, want, got)
+		}
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/typed" {
+			w.Header().Set("Content-Type", "text/css")
+		} else {
+			// Prevent the backend from sniffing a type
+			w.Header()["Content-Type"] = nil
+		}
+		w.Write([]byte("body"))
+	}))
+	defer backend.Close()
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{DefaultContentType: "application/octet-stream"})
+	front := httptest.NewServer(route.Handler)
+	defer front.Close()
+
+	for path, want := range map[string]string{"/untyped": "application/octet-stream", "/typed": "text/css"} {
+		resp, err := http.Get(front.URL + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Content-Type"); got != want {
+			t.Errorf("%s: expected Content-Type %q, got %q", path, want, got)
+		}
+	}
+}
+
+func TestMirrorTo(t *testing.T) {
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.URL.EscapedPath() + " " + string(body)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+	var primaryPath, primaryBody string
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		primaryPath, primaryBody = r.URL.EscapedPath(), string(body)
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+
+	tests := []struct {
+		name string
+		opts proxy.RouteOptions
+		path string
+		want string // Path both targets receive
+	}{
+		{"plain", proxy.RouteOptions{}, "/hook", "/hook"},
+		// The shadow gets the same rewritten path as the primary
+		{"strip_path_prefix", proxy.RouteOptions{StripPathPrefix: "/app"}, "/app/hook", "/hook"},
+		{"trailing_slash", proxy.RouteOptions{StripPathPrefix: "/app", TrailingSlash: proxy.TrailingSlashAdd}, "/app/hook", "/hook/"},
+		{"preserve_raw_path", proxy.RouteOptions{StripPathPrefix: "/app", PreserveRawPath: true}, "/app/a%2Fb", "/a%2Fb"},
+	}
+	for _, tt := range tests {
+		tt.opts.MirrorTo = shadow.URL
+		route := proxy.CreateRouteWithOptions(primary.URL, tt.opts)
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("POST", "http://app.example.com"+tt.path, strings.NewReader("payload")))
+
+		if rec.Body.String() != "primary" || primaryBody != "payload" || primaryPath != tt.want {
+			t.Errorf("%s: expected client to get the primary response with the request intact, got %q (primary saw %s %q)", tt.name, rec.Body.String(), primaryPath, primaryBody)
+		}
+		select {
+		case got := <-mirrored:
+			if got != tt.want+" payload" {
+				t.Errorf("%s: expected mirror to receive a copy of the request, got %q", tt.name, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s: mirror target never received the request", tt.name)
+		}
+	}
+}
+
+func TestMirrorInFlightLimit(t *testing.T) {
+	// A stuck shadow target holds the mirror's 32 slots, further copies are dropped, not queued
+	var arrived atomic.Int32
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Add(1)
+		<-release
+	}))
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer primary.Close()
+
+	route := proxy.CreateRouteWithOptions(primary.URL, proxy.RouteOptions{MirrorTo: shadow.URL})
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("POST", "/hook", strings.NewReader("payload")))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected every primary request to succeed, got %d", rec.Code)
+		}
+	}
+	for deadline := time.Now().Add(2 * time.Second); arrived.Load() < 32 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	shadow.Close() // Waits for the requests the shadow received
+	if n := arrived.Load(); n != 32 {
+		t.Errorf("Expected 32 of 100 copies to reach a stuck mirror, got %d", n)
+	}
+}
+
+func TestMirrorStripsHopByHop(t *testing.T) {
+	mirrored := make(chan http.Header, 1)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Header.Clone()
+		<-release // A stuck mirror must not hold up the client
+	}))
+	defer shadow.Close()
+	defer close(release)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+
+	route := proxy.CreateRouteWithOptions(primary.URL, proxy.RouteOptions{MirrorTo: shadow.URL})
+	req := httptest.NewRequest("POST", "http://app.example.com/hook", strings.NewReader("payload"))
+	req.Header.Set("Connection", "keep-alive, X-Session-Hint")
+	req.Header.Set("X-Session-Hint", "abc")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("X-Request-Id", "42")
+	rec := httptest.NewRecorder()
+	route.Handler.ServeHTTP(rec, req)
+	if rec.Body.String() != "primary" {
+		t.Fatalf("Expected the primary response without waiting for the mirror, got %q", rec.Body.String())
+	}
+
+	select {
+	case got := <-mirrored:
+		for _, name := range []string{"Connection", "X-Session-Hint", "Keep-Alive", "Te", "Proxy-Authorization"} {
+			if value := got.Get(name); value != "" {
+				t.Errorf("Expected %s to stay off the mirror, got %q", name, value)
+			}
+		}
+		if got.Get("X-Request-Id") != "42" {
+			t.Errorf("Expected end-to-end headers on the mirror, got %v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Mirror target never received the request")
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		mode, path, want string
+	}{
+		{proxy.TrailingSlashAdd, "/docs?page=2", "/docs/?page=2"},
+		{proxy.TrailingSlashAdd, "/docs/", "/docs/"},
+		{proxy.TrailingSlashAdd, "/style.css", "/style.css"},
+		{proxy.TrailingSlashRemove, "/docs/?page=2", "/docs?page=2"},
+		{proxy.TrailingSlashRemove, "/", "/"},
+		{proxy.TrailingSlashKeep, "/docs/", "/docs/"},
+	}
+	for _, tt := range tests {
+		route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{TrailingSlash: tt.mode})
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Body.String() != tt.want {
+			t.Errorf("%s %s: expected upstream to get %s, got %s", tt.mode, tt.path, tt.want, rec.Body.String())
+		}
+	}
+}
+
+// h2cClient speaks HTTP/2 cleartext with prior knowledge, like a plaintext gRPC client
+func h2cClient() *http.Client {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: transport}
+}
+
+// h2cServer starts a test server accepting HTTP/1.1 and HTTP/2 cleartext
+func h2cServer(handler http.Handler) *httptest.Server {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	return srv
+}
+
+func TestGRPCRoute(t *testing.T) {
+	var backendProto int
+	var requestTrailer string
+	backend := h2cServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendProto = r.ProtoMajor
+		msg, _ := io.ReadAll(r.Body)
+		requestTrailer = r.Trailer.Get("X-Checksum")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(msg) // echo the length-prefixed message
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "OK")
+	}))
+	defer backend.Close()
+
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{GRPC: true})
+	front := h2cServer(route.Handler)
+	defer front.Close()
+
+	message := []byte{0, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}
+	req, _ := http.NewRequest("POST", front.URL+"/echo.Echo/Say", io.NopCloser(bytes.NewReader(message)))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Trailer = http.Header{"X-Checksum": {"abc"}}
+	resp, err := h2cClient().Do(req)
+	if err != nil {
+		t.Fatalf("gRPC call failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 2 || backendProto != 2 {
+		t.Errorf("Expected HTTP/2 on both sides, got client HTTP/%d backend HTTP/%d", resp.ProtoMajor, backendProto)
+	}
+	if !bytes.Equal(body, message) {
+		t.Errorf("Expected echoed message, got %v", body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "OK" {
+		t.Errorf("Expected grpc-status trailers to propagate, got %v", resp.Trailer)
+	}
+	if requestTrailer != "abc" {
+		t.Errorf("Expected request trailer to reach backend, got %q", requestTrailer)
+	}
+
+	// An unreachable backend is reported as gRPC status UNAVAILABLE
+	backend.Close()
+	req, _ = http.NewRequest("POST", front.URL+"/echo.Echo/Say", bytes.NewReader(message))
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err = h2cClient().Do(req)
+	if err != nil {
+		t.Fatalf("gRPC call failed: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if status := resp.Header.Get("Grpc-Status") + resp.Trailer.Get("Grpc-Status"); status != "14" {
+		t.Errorf("Expected grpc-status 14 for unreachable backend, got %q (status %d)", status, resp.StatusCode)
+	}
+}
+
+func TestMaxResponseBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 100)
+		if r.URL.Path == "/streamed" {
+			// Flushing first leaves the length unknown, so the limit is hit while relaying
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{MaxResponseBody: 50})
+	front := httptest.NewServer(route.Handler)
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/sized")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 for an oversized response with Content-Length, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(front.URL + "/streamed")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil || len(body) > 50 {
+		t.Errorf("Expected the streamed response to be cut off at 50 bytes, got %d bytes and err %v", len(body), err)
+	}
+
+	small := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{MaxResponseBody: 100})
+	rec := httptest.NewRecorder()
+	small.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/streamed", nil))
+	if rec.Body.Len() != 100 {
+		t.Errorf("Expected a body at the limit to be relayed in full, got %d bytes", rec.Body.Len())
+	}
+}
+
+func TestUpstreamClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	if err := ssl.EnsureCertFiles(certFile, keyFile); err != nil {
+		t.Fatalf("Error generating client cert: %v", err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("authenticated"))
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		opts proxy.RouteOptions
+		want int
+	}{
+		{proxy.RouteOptions{TrustInvalidCert: true, UpstreamClientCert: certFile, UpstreamClientKey: keyFile}, http.StatusOK},
+		{proxy.RouteOptions{TrustInvalidCert: true}, http.StatusBadGateway},
+	} {
+		route := proxy.CreateRouteWithOptions(backend.URL, tc.opts)
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != tc.want {
+			t.Errorf("With client cert %q expected %d, got %d", tc.opts.UpstreamClientCert, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestAdmissionShedsOverCeiling(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 2)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+	admission := &proxy.Admission{}
+	admission.SetLimit(2)
+
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			admission.Serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), slow)
+			done <- struct{}{}
+		}()
+	}
+	<-entered
+	<-entered
+
+	rec := httptest.NewRecorder()
+	admission.Serve(rec, httptest.NewRequest("GET", "/", nil), slow)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After over the ceiling, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	<-done
+	<-done
+	if n := admission.InFlight(); n != 0 {
+		t.Errorf("Expected no requests in flight after completion, got %d", n)
+	}
+	rec = httptest.NewRecorder()
+	admission.Serve(rec, httptest.NewRequest("GET", "/", nil), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected requests to be admitted again, got %d", rec.Code)
+	}
+}
+
+// webSocketEchoHandler upgrades WebSocket handshakes and echoes the first line sent over the tunnel
+func webSocketEchoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Connection") != "Upgrade" || r.Header.Get("Upgrade") != "websocket" {
+		http.Error(w, "missing upgrade headers: "+r.Header.Get("Connection"), http.StatusBadRequest)
+		return
+	}
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	buf.Flush()
+	line, _ := buf.ReadString('\n')
+	conn.Write([]byte("echo " + line))
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(webSocketEchoHandler))
+	defer backend.Close()
+	for name, opts := range map[string]proxy.RouteOptions{
+		// The handshake timeout must not cut off the tunnel once the target answered
+		"upgrade timeout": {AccessLog: true, UpgradeTimeout: 50 * time.Millisecond},
+		// The 101 body is the tunnel itself, it must stay writable
+		"max_response_body": {MaxResponseBody: 1 << 20},
+	} {
+		front := httptest.NewServer(proxy.CreateRouteWithOptions(backend.URL, opts).Handler)
+		// Clients vary in how they spell the handshake headers, all of these must upgrade
+		for _, headers := range []string{
+			"Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n",
+			"Connection: upgrade\r\nUpgrade: WebSocket\r\n",
+			"Connection:  keep-alive ,  UPGRADE \r\nUpgrade:  websocket , h2c \r\n",
+			"Connection: keep-alive\r\nConnection: Upgrade\r\nUpgrade: h2c, websocket\r\n",
+		} {
+			if line := webSocketEcho(t, front, headers, 100*time.Millisecond); line != "echo ping\n" {
+				t.Errorf("%s, %q: expected data to flow over the upgraded connection, got %q", name, headers, line)
+			}
+		}
+		front.Close()
+	}
+}
+
+// webSocketEcho upgrades a connection to front with the given handshake headers, waits, then sends
+// "ping" and returns the line the echo backend answers with (empty when the upgrade failed)
+func webSocketEcho(t *testing.T, front *httptest.Server, headers string, wait time.Duration) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(wait + 2*time.Second))
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: app.example.com\r\n" + headers + "\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Errorf("%q: reading upgrade response failed: %v", headers, err)
+		return ""
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("%q: expected 101 from the backend, got %d", headers, resp.StatusCode)
+		return ""
+	}
+	time.Sleep(wait)
+	conn.Write([]byte("ping\n"))
+	line, _ := reader.ReadString('\n')
+	return line
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		target, path, want string
+	}{
+		{backend.URL, "/app/page?x=1", "/page?x=1"},
+		{backend.URL, "/app", "/"},
+		{backend.URL, "/app/", "/"},
+		{backend.URL, "/apple", "/apple"},
+		{backend.URL, "/other", "/other"},
+		{backend.URL + "/base", "/app/page", "/base/page"},
+	}
+	for _, tt := range tests {
+		route := proxy.CreateRouteWithOptions(tt.target, proxy.RouteOptions{StripPathPrefix: "/app/"})
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Body.String() != tt.want {
+			t.Errorf("%s via %s: expected upstream to get %s, got %s", tt.path, tt.target, tt.want, rec.Body.String())
+		}
+	}
+}
+
+func TestLogRequestBody(t *testing.T) {
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	}))
+	defer backend.Close()
+
+	var buf bytes.Buffer
+	logger.Logger.SetOutput(&buf)
+	defer logger.Logger.SetOutput(os.Stdout)
+
+	payload := `{"event":"push","password":"hunter2","padding":"` + strings.Repeat("x", 100) + `"}`
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{LogRequestBody: 50})
+	route.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://hooks.example.com/hook", strings.NewReader(payload)))
+
+	if received != payload {
+		t.Errorf("Expected the backend to get the full body, got %d of %d bytes", len(received), len(payload))
+	}
+	logged := buf.String()
+	if !strings.Contains(logged, `\"event\":\"push\"`) || !strings.Contains(logged, "truncated") {
+		t.Errorf("Expected the truncated body in the log, got %q", logged)
+	}
+	if strings.Contains(logged, "hunter2") || !strings.Contains(logged, "[REDACTED]") {
+		t.Errorf("Expected the password to be redacted, got %q", logged)
+	}
+}
+
+func TestStripPathPrefixRedirect(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/private":
+			http.Redirect(w, r, "/login?next=/private", http.StatusFound)
+		case "/external":
+			http.Redirect(w, r, "https://sso.example.com/login", http.StatusFound)
+		}
+	}))
+	defer backend.Close()
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{StripPathPrefix: "/app"})
+
+	for path, want := range map[string]string{
+		"/app/private":  "/app/login?next=/private",
+		"/app/external": "https://sso.example.com/login",
+		"/private":      "/login?next=/private", // Not under the prefix, nothing was stripped
+	} {
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if got := rec.Header().Get("Location"); got != want {
+			t.Errorf("%s: expected Location %q, got %q", path, want, got)
+		}
+	}
+}
+
+func TestAdmissionDrainMode(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	readiness := proxy.LocalRoute(http.StatusOK, "ready")
+	readiness.Readiness = true
+	router := &proxy.Router{
+		Default: proxy.CreateRoute(backend.URL, false),
+		LocalPaths: map[string]*proxy.Route{
+			"/healthz": proxy.LocalRoute(http.StatusOK, "ok"),
+			"/ready":   readiness,
+		},
+	}
+	admission := &proxy.Admission{}
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://app.example.com"+path, nil)
+		admission.ServeRoute(rec, req, router.Match(req))
+		return rec
+	}
+
+	admission.SetDraining(true)
+	if rec := serve("/"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After while draining, got %d", rec.Code)
+	}
+	// Liveness keeps answering, readiness reports the drain so load balancers move traffic away
+	if rec := serve("/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the health path to answer 200 while draining, got %d", rec.Code)
+	}
+	if rec := serve("/ready"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the readiness path to answer 503 while draining, got %d", rec.Code)
+	}
+
+	admission.SetDraining(false)
+	for _, path := range []string{"/", "/healthz", "/ready"} {
+		if rec := serve(path); rec.Code != http.StatusOK {
+			t.Errorf("%s: expected 200 after draining ends, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestUpstreamCertLogged(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	var buf bytes.Buffer
+	logger.Logger.SetOutput(&buf)
+	defer logger.Logger.SetOutput(os.Stdout)
+
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{TrustInvalidCert: true, DisableKeepAlive: true})
+	for i := 0; i < 2; i++ {
+		route.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	logged := buf.String()
+	if strings.Count(logged, "certificate: subject=") != 1 {
+		t.Fatalf("Expected the upstream certificate to be logged once, got %q", logged)
+	}
+	if !strings.Contains(logged, `issuer="O=Acme Co"`) || !strings.Contains(logged, "expires=") {
+		t.Errorf("Expected issuer and expiry in the log, got %q", logged)
+	}
+
+	// The seen set belongs to the route, a rebuilt route (as on reload) starts over
+	route = proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{TrustInvalidCert: true, DisableKeepAlive: true})
+	route.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if n := strings.Count(buf.String(), "certificate: subject="); n != 2 {
+		t.Errorf("Expected a rebuilt route to log the certificate again, got %d lines", n)
+	}
+}
+
+func TestMultipleSetCookiePreserved(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark", Path: "/"})
+		http.SetCookie(w, &http.Cookie{Name: "lang", Value: "en", Expires: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)})
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{DefaultContentType: "text/plain", AccessLog: true})
+	front := httptest.NewServer(route.Handler)
+	defer front.Close()
+
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) != 3 {
+		t.Fatalf("Expected 3 distinct Set-Cookie headers, got %d: %q", len(cookies), cookies)
+	}
+	if !strings.HasPrefix(cookies[2], "lang=en") || !strings.Contains(cookies[2], "Expires=Tue, 01 Jan 2030") {
+		t.Errorf("Expected the cookie with a comma in Expires to stay intact, got %q", cookies[2])
+	}
+}
+
+func TestEmbeddedErrorPages(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", browserAccept)
+	req.Header.Set("X-Request-ID", "req-7")
+	proxy.CreateRoute(unreachable.URL, false).Handler.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	if rec.Code != http.StatusBadGateway || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected the HTML 502 page, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(body, "<h2>Bad Gateway</h2>") || !strings.Contains(body, "upstream unavailable") || !strings.Contains(body, "req-7") {
+		t.Errorf("Expected the embedded 502 page with the message and request ID, got %q", body)
+	}
+
+	// Statuses without a page stay plain text for browsers too
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Accept", browserAccept)
+	proxy.CreateRouteWithOptions(unreachable.URL, proxy.RouteOptions{OptionsMode: proxy.OptionsReject}).Handler.ServeHTTP(rec, req)
+	if !strings.HasPrefix(rec.Body.String(), "405 - GoLangProxy:") {
+		t.Errorf("Expected a plain-text 405, got %q", rec.Body.String())
+	}
+}
+
+func TestProxyErrorsJSON(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "backend says no", http.StatusForbidden)
+	}))
+	defer backend.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	draining := &proxy.Admission{}
+	draining.SetDraining(true)
+	router := &proxy.Router{FallbackHost: "missing.example.com"}
+	handlers := map[string]struct {
+		handler http.Handler
+		method  string
+		status  int
+	}{
+		"unreachable target":  {proxy.CreateRoute(unreachable.URL, false).Handler, "GET", http.StatusBadGateway},
+		"options rejected":    {proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{OptionsMode: proxy.OptionsReject}).Handler, "OPTIONS", http.StatusMethodNotAllowed},
+		"host not configured": {router.Lookup("unknown.example.com").Handler, "GET", http.StatusNotFound},
+		"drain mode": {http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			draining.Serve(w, r, http.NotFoundHandler())
+		}), "GET", http.StatusServiceUnavailable},
+	}
+	for name, tc := range handlers {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, "http://unknown.example.com/", nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-Request-ID", "req-42")
+		tc.handler.ServeHTTP(rec, req)
+
+		var body struct {
+			Status    int    `json:"status"`
+			Error     string `json:"error"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: expected a JSON error, got %q", name, rec.Body.String())
+			continue
+		}
+		if rec.Code != tc.status || body.Status != tc.status || body.Error != http.StatusText(tc.status) || body.Message == "" || body.RequestID != "req-42" {
+			t.Errorf("%s: unexpected error response %d %+v", name, rec.Code, body)
+		}
+	}
+
+	// Without an Accept header for JSON the proxy keeps plain text
+	rec := httptest.NewRecorder()
+	proxy.CreateRoute(unreachable.URL, false).Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !strings.HasPrefix(rec.Body.String(), "502 - GoLangProxy:") {
+		t.Errorf("Expected a plain-text 502, got %q", rec.Body.String())
+	}
+
+	// Target error bodies are relayed untouched
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	proxy.CreateRoute(backend.URL, false).Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || rec.Body.String() != "backend says no\n" {
+		t.Errorf("Expected the target's error to pass through, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDevModeTrustsOnlyLoopback(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	for target, want := range map[string]int{
+		"https://127.0.0.1:" + port: http.StatusOK,
+		"https://localhost:" + port: http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		proxy.CreateRouteWithOptions(target, proxy.RouteOptions{DevMode: true}).Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != want {
+			t.Errorf("%s in dev_mode: expected %d, got %d", target, want, rec.Code)
+		}
+	}
+
+	// Without dev_mode the self-signed loopback cert is rejected as before
+	rec := httptest.NewRecorder()
+	proxy.CreateRoute("https://127.0.0.1:"+port, false).Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected verification without dev_mode, got %d", rec.Code)
+	}
+
+	// Non-loopback targets keep verifying in dev_mode; the upstream proxy makes 192.0.2.1 reach the test server
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := net.Dial("tcp", backend.Listener.Addr().String())
+		if err != nil {
+			return
+		}
+		client, _, _ := http.NewResponseController(w).Hijack()
+		client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(conn, client)
+		io.Copy(client, conn)
+	}))
+	defer upstream.Close()
+	rec = httptest.NewRecorder()
+	opts := proxy.RouteOptions{DevMode: true, UpstreamProxy: upstream.URL}
+	proxy.CreateRouteWithOptions("https://192.0.2.1:"+port, opts).Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected dev_mode to keep verifying non-loopback targets, got %d", rec.Code)
+	}
+}
+
+func TestRequestTimeoutStatus(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	tests := []struct {
+		opts       proxy.RouteOptions
+		wantStatus int
+		wantBody   string
+	}{
+		{proxy.RouteOptions{RequestTimeout: 50 * time.Millisecond}, http.StatusGatewayTimeout, "upstream timed out"},
+		{proxy.RouteOptions{RequestTimeout: 50 * time.Millisecond, TimeoutStatus: http.StatusRequestTimeout, TimeoutMessage: "try again later"}, http.StatusRequestTimeout, "try again later"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		proxy.CreateRouteWithOptions(backend.URL, tt.opts).Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/slow", nil))
+		if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+			t.Errorf("Expected %d %q on timeout, got %d %q", tt.wantStatus, tt.wantBody, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestRequestTimeoutOnlyCoversHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			webSocketEchoHandler(w, r)
+			return
+		}
+		io.WriteString(w, "first half, ")
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "second half")
+	}))
+	defer backend.Close()
+	front := httptest.NewServer(proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{RequestTimeout: 100 * time.Millisecond}).Handler)
+	defer front.Close()
+
+	// The headers arrive at once, the body may take longer than request_timeout
+	resp, err := http.Get(front.URL + "/download")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "first half, second half" {
+		t.Errorf("Expected the slow body in full, got %q %v", body, err)
+	}
+
+	// An established tunnel outlives request_timeout
+	if line := webSocketEcho(t, front, "Connection: Upgrade\r\nUpgrade: websocket\r\n", 300*time.Millisecond); line != "echo ping\n" {
+		t.Errorf("Expected the WebSocket tunnel to stay open past request_timeout, got %q", line)
+	}
+}
+
+func TestCloseDelimitedResponse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	body := strings.Repeat("close-delimited ", 4096)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// No Content-Length and no chunking: the end of the body is the closed connection
+			http.ReadRequest(bufio.NewReader(conn))
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n" + body))
+			conn.Close()
+		}
+	}()
+
+	for _, opts := range []proxy.RouteOptions{{}, {DefaultContentType: "text/plain", MaxResponseBody: 1 << 20}} {
+		front := httptest.NewServer(proxy.CreateRouteWithOptions("http://"+listener.Addr().String(), opts).Handler)
+		resp, err := http.Get(front.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		front.Close()
+		if err != nil || string(got) != body {
+			t.Errorf("With %+v expected the full %d byte body, got %d bytes (err %v)", opts, len(body), len(got), err)
+		}
+	}
+}
+
+func TestRequestSmugglingFraming(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		seen = append(seen, r.Method+" "+r.URL.Path+" "+string(body))
+		mu.Unlock()
+	}))
+	defer backend.Close()
+	front := httptest.NewServer(proxy.CreateRoute(backend.URL, false).Handler)
+	defer front.Close()
+
+	smuggled := "GET /admin HTTP/1.1\r\nHost: a\r\n\r\n"
+	tests := []struct {
+		name, raw  string
+		wantStatus int
+		wantSeen   []string
+	}{
+		{"CL.TE", "POST /cl-te HTTP/1.1\r\nHost: a\r\nContent-Length: 40\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n" + smuggled, http.StatusOK, []string{"POST /cl-te "}},
+		{"TE.CL", "POST /te-cl HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", http.StatusOK, []string{"POST /te-cl hello"}},
+		{"conflicting CL", "POST /cl-cl HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 40\r\n\r\nhello" + smuggled, http.StatusBadRequest, nil},
+		{"obfuscated TE", "POST /te-te HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: xchunked\r\n\r\nhello", http.StatusNotImplemented, nil},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		seen = nil
+		mu.Unlock()
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte(tt.raw))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%s: reading response failed: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		// Anything left after the first request must not reach the target as a second request
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+		mu.Lock()
+		got := strings.Join(seen, "|")
+		mu.Unlock()
+		if resp.StatusCode != tt.wantStatus || got != strings.Join(tt.wantSeen, "|") {
+			t.Errorf("%s: expected %d with target seeing %q, got %d and %q", tt.name, tt.wantStatus, tt.wantSeen, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestPreserveRawPath(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		target, path, want string
+	}{
+		{backend.URL, "/app/bucket/a%2Fb%2fc?v=1", "/bucket/a%2Fb%2fc?v=1"},
+		{backend.URL, "/app/refs/x|y", "/refs/x|y"},
+		{backend.URL, "/app%2Fkey", "/app%2Fkey"},
+		{backend.URL, "/app", "/"},
+		{backend.URL + "/base", "/app/a%2Fb", "/base/a%2Fb"},
+	}
+	for _, tt := range tests {
+		route := proxy.CreateRouteWithOptions(tt.target, proxy.RouteOptions{PreserveRawPath: true, StripPathPrefix: "/app"})
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Body.String() != tt.want {
+			t.Errorf("%s via %s: expected upstream to get %s, got %s", tt.path, tt.target, tt.want, rec.Body.String())
+		}
+	}
+}
+
+func TestInjectDelay(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		opts    proxy.RouteOptions
+		delayed bool
+	}{
+		{proxy.RouteOptions{ChaosEnabled: true, InjectDelay: "100ms"}, true},
+		{proxy.RouteOptions{ChaosEnabled: true, InjectDelay: "100ms-150ms"}, true},
+		{proxy.RouteOptions{InjectDelay: "100ms"}, false},
+	} {
+		route := proxy.CreateRouteWithOptions(backend.URL, tc.opts)
+		start := time.Now()
+		route.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		elapsed := time.Since(start)
+		if tc.delayed && elapsed < 100*time.Millisecond {
+			t.Errorf("%+v: expected at least 100ms delay, took %s", tc.opts, elapsed)
+		}
+		if !tc.delayed && elapsed >= 100*time.Millisecond {
+			t.Errorf("Expected inject_delay to be ignored without chaos_enabled, took %s", elapsed)
+		}
+	}
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{RetryOnStatus: []int{503}})
+	rec := httptest.NewRecorder()
+	route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("Expected GET to be retried into a 200, got %d after %d calls", rec.Code, calls.Load())
+	}
+
+	// Requests with a body aren't retried, the target may have acted on the first attempt
+	calls.Store(0)
+	rec = httptest.NewRecorder()
+	route.Handler.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader("data")))
+	if rec.Code != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("Expected POST to be passed through once, got %d after %d calls", rec.Code, calls.Load())
+	}
+}
+
+func TestUpstreamPin(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	sum := sha256.Sum256(backend.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	for _, tc := range []struct {
+		pins []string
+		want int
+	}{
+		{[]string{"sha256/" + pin}, http.StatusOK},
+		{[]string{base64.StdEncoding.EncodeToString(make([]byte, 32)), pin}, http.StatusOK},
+		{[]string{base64.StdEncoding.EncodeToString(make([]byte, 32))}, http.StatusBadGateway},
+	} {
+		route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{TrustInvalidCert: true, UpstreamPins: tc.pins})
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != tc.want {
+			t.Errorf("Pins %v: expected %d, got %d", tc.pins, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestWebSocketHandshakeTimeout(t *testing.T) {
+	// A target that accepts connections but never answers the handshake
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	route := proxy.CreateRouteWithOptions("http://"+silent.Addr().String(), proxy.RouteOptions{UpgradeTimeout: 200 * time.Millisecond})
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	route.Handler.ServeHTTP(rec, req)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the handshake to time out after 200ms, took %s", elapsed)
+	}
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 on handshake timeout, got %d", rec.Code)
+	}
+
+	// Plain requests to the same target are not subject to the handshake timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	rec = httptest.NewRecorder()
+	start = time.Now()
+	route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected a plain request to wait for the target, gave up after %s", elapsed)
+	}
+}
+
+// slowWriter is a client that doesn't read the response until released or a second has passed
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	released chan struct{}
+	waited   bool // Write had to give up waiting
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.released:
+	case <-time.After(time.Second):
+		w.waited = true
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestBufferResponse(t *testing.T) {
+	body := strings.Repeat("x", 64<<10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{BufferResponse: true})
+	client := &slowWriter{ResponseRecorder: httptest.NewRecorder(), released: make(chan struct{})}
+	// The upstream connection goes back to the pool once the body was read from the target
+	var once sync.Once
+	trace := &httptrace.ClientTrace{PutIdleConn: func(error) { once.Do(func() { close(client.released) }) }}
+	req := httptest.NewRequest("GET", "/", nil)
+	route.Handler.ServeHTTP(client, req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+	if client.waited {
+		t.Errorf("Expected the upstream connection to be released before the client read the response")
+	}
+	if client.Body.String() != body || client.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("Expected the full %d byte body with its length, got %d bytes", len(body), client.Body.Len())
+	}
+}
+
+func TestMaxHeaderValue(t *testing.T) {
+	var proxied atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+	}))
+	defer backend.Close()
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{MaxHeaderValue: 1024})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", "session="+strings.Repeat("a", 2000))
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+	route.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestHeaderFieldsTooLarge || !strings.Contains(rec.Body.String(), "header Cookie is 2008 bytes") {
+		t.Errorf("Expected 431 naming the oversized header, got %d %q", rec.Code, rec.Body.String())
+	}
+	if proxied.Load() != 0 {
+		t.Errorf("Expected the oversized request not to reach the target")
+	}
+
+	req.Header.Set("Cookie", "session="+strings.Repeat("a", 1000))
+	rec = httptest.NewRecorder()
+	route.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || proxied.Load() != 1 {
+		t.Errorf("Expected headers within the limit to be proxied, got %d", rec.Code)
+	}
+}
+
+// endlessBody is a fast upstream body counting how much of it the proxy has read
+type endlessBody struct {
+	read      atomic.Int64
+	remaining int64
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := min(int64(len(p)), b.remaining)
+	b.remaining -= n
+	b.read.Add(n)
+	return int(n), nil
+}
+
+func (b *endlessBody) Close() error { return nil }
+
+type bodyTransport struct{ body io.ReadCloser }
+
+func (t bodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: t.body, ContentLength: -1, Request: req}, nil
+}
+
+func TestSlowClientBackpressure(t *testing.T) {
+	for _, tc := range []struct {
+		opts      proxy.RouteOptions
+		readAhead int64
+	}{
+		{proxy.RouteOptions{}, 32 << 10},
+		{proxy.RouteOptions{StreamBuffer: 4096}, 4096},
+		{proxy.RouteOptions{BufferResponse: true}, 1<<20 + 32<<10},
+	} {
+		body := &endlessBody{remaining: 64 << 20}
+		route := proxy.CreateRouteWithOptions("http://127.0.0.1:1", tc.opts)
+		route.Proxy.Transport = bodyTransport{body}
+
+		client := &stalledWriter{ResponseRecorder: httptest.NewRecorder(), released: make(chan struct{})}
+		done := make(chan struct{})
+		go func() {
+			route.Handler.ServeHTTP(client, httptest.NewRequest("GET", "/", nil))
+			close(done)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		if read := body.read.Load(); read > tc.readAhead+1 {
+			t.Errorf("%+v: expected at most %d bytes read ahead of a stalled client, read %d", tc.opts, tc.readAhead, read)
+		}
+		close(client.released)
+		<-done
+		if body.read.Load() != 64<<20 {
+			t.Errorf("%+v: expected the whole body to be relayed once the client reads, got %d bytes", tc.opts, body.read.Load())
+		}
+	}
+}
+
+// stalledWriter is a client that reads nothing until released and then discards the body
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	released chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	<-w.released
+	return len(p), nil
+}
+
+func TestDebugHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer backend.Close()
+
+	for _, debug := range []bool{true, false} {
+		route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{DebugHeaders: debug})
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		upstream, duration := rec.Header().Get("X-Proxy-Upstream"), rec.Header().Get("X-Proxy-Duration-Ms")
+		if !debug {
+			if upstream != "" || duration != "" {
+				t.Errorf("Expected no debug headers with debug_headers off, got %q %q", upstream, duration)
+			}
+			continue
+		}
+		if upstream != backend.URL {
+			t.Errorf("Expected X-Proxy-Upstream %s, got %q", backend.URL, upstream)
+		}
+		if ms, err := strconv.Atoi(duration); err != nil || ms < 20 {
+			t.Errorf("Expected X-Proxy-Duration-Ms of at least 20, got %q", duration)
+		}
+	}
+}
+
+func TestConnLimit(t *testing.T) {
+	limit := proxy.NewConnLimit(2)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Listener = limit.Listener(server.Listener)
+	server.Start()
+	defer server.Close()
+
+	// Each connection sends a request and keeps the connection open
+	answered := make(chan int, 3)
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		go func(i int) {
+			if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+				answered <- i
+			}
+		}(i)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-answered:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected the first two connections to be served")
+		}
+	}
+	select {
+	case i := <-answered:
+		t.Fatalf("Expected connection %d over max_connections to wait", i)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if open := limit.Open(); open != 2 {
+		t.Errorf("Expected 2 open connections, got %d", open)
+	}
+
+	// Closing a connection lets the waiting one in
+	conns[0].Close()
+	select {
+	case <-answered:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the waiting connection to be served once a slot freed up")
+	}
+}
+
+func TestConnLimitIdleTimeout(t *testing.T) {
+	limit := proxy.NewConnLimit(1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.IdleTimeout = 100 * time.Millisecond
+	server.Listener = limit.Listener(server.Listener)
+	server.Start()
+	defer server.Close()
+
+	// A keep-alive client that goes quiet after its request holds the only slot until it times out
+	idle, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer idle.Close()
+	idle.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if _, err := http.ReadResponse(bufio.NewReader(idle), nil); err != nil {
+		t.Fatalf("First request failed: %v", err)
+	}
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected the idle connection's slot to be released, got %v", err)
+	}
+	resp.Body.Close()
+	if open := limit.Open(); open != 1 {
+		t.Errorf("Expected only the new connection to be open, got %d", open)
+	}
+}
+
+func TestDuplicateHeaders(t *testing.T) {
+	// A sloppy backend repeating Content-Type and sending a lowercase header name
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, _ := http.NewResponseController(w).Hijack()
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\ncontent-type: text/html\r\nContent-Type: application/json\r\nx-backend-id: 7\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+		buf.Flush()
+	}))
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		mode   string
+		status int
+		want   []string
+	}{
+		{"", http.StatusOK, []string{"text/html", "application/json"}},
+		{"first", http.StatusOK, []string{"text/html"}},
+		{"last", http.StatusOK, []string{"application/json"}},
+		{"reject", http.StatusBadGateway, nil},
+	} {
+		route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{DuplicateHeaders: tc.mode})
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != tc.status {
+			t.Errorf("duplicate_headers %q: expected %d, got %d", tc.mode, tc.status, rec.Code)
+			continue
+		}
+		if tc.want == nil {
+			continue
+		}
+		if got := rec.Header().Values("Content-Type"); !slices.Equal(got, tc.want) {
+			t.Errorf("duplicate_headers %q: expected Content-Type %v, got %v", tc.mode, tc.want, got)
+		}
+		if _, ok := rec.Header()["X-Backend-Id"]; !ok {
+			t.Errorf("Expected header names to be canonical, got %v", rec.Header())
+		}
+	}
+}
+
+func TestRestrictRedirects(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", r.URL.Query().Get("to"))
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer backend.Close()
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{RestrictRedirects: true, RedirectAllow: []string{"*.sso.example.net"}})
+
+	tests := []struct {
+		location string
+		status   int
+	}{
+		{"/login", http.StatusFound},
+		{"https://app.example.com/login", http.StatusFound},
+		{"https://id.sso.example.net/auth", http.StatusFound},
+		{"https://evil.test/phish", http.StatusBadGateway},
+		{"//evil.test/phish", http.StatusBadGateway},
+		{`/\evil.test/phish`, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://app.example.com/?to="+url.QueryEscape(tt.location), nil))
+		if rec.Code != tt.status {
+			t.Errorf("Location %q: expected %d, got %d", tt.location, tt.status, rec.Code)
+		}
+		if rec.Code == http.StatusBadGateway && rec.Header().Get("Location") != "" {
+			t.Errorf("Location %q: expected the blocked redirect not to be relayed", tt.location)
+		}
+	}
+}
+
+func TestForwardedPorts(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{ForwardedPort: true, ClientPortHeader: "X-Client-Port"})
+	var clientAddr string
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientAddr = r.RemoteAddr
+		route.Handler.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	req, _ := http.NewRequest("GET", front.URL, nil)
+	req.Header.Set("X-Client-Port", "1") // Spoofed values are replaced
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	_, clientPort, _ := net.SplitHostPort(clientAddr)
+	_, listenPort, _ := net.SplitHostPort(strings.TrimPrefix(front.URL, "http://"))
+	if got.Get("X-Client-Port") != clientPort || got.Get("X-Forwarded-Port") != listenPort {
+		t.Errorf("Expected client port %s and listener port %s, got %q and %q", clientPort, listenPort, got.Get("X-Client-Port"), got.Get("X-Forwarded-Port"))
+	}
+}
+
+func TestRangePassthrough(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, strings.NewReader(content))
+	}))
+	defer backend.Close()
+
+	for _, opts := range []proxy.RouteOptions{{}, {BufferResponse: true}} {
+		front := httptest.NewServer(proxy.CreateRouteWithOptions(backend.URL, opts).Handler)
+		req, _ := http.NewRequest("GET", front.URL, nil)
+		req.Header.Set("Range", "bytes=10-19")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			front.Close()
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		front.Close()
+		if resp.StatusCode != http.StatusPartialContent || string(body) != content[10:20] ||
+			resp.Header.Get("Content-Range") != "bytes 10-19/1000" || resp.Header.Get("Accept-Ranges") != "bytes" {
+			t.Errorf("buffer_response %t: expected the target's 206 for bytes 10-19, got %d %q %q", opts.BufferResponse, resp.StatusCode, resp.Header.Get("Content-Range"), body)
+		}
+	}
+}
+
+func TestUpstreamDeadPooledConnection(t *testing.T) {
+	// The target answers once per connection and then dies without responding, leaving the proxy
+	// with a pooled connection that fails on its next use
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(reader); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				http.ReadRequest(reader) // The next request on this connection is never answered
+			}()
+		}
+	}()
+
+	route := proxy.CreateRouteWithOptions("http://"+listener.Addr().String(), proxy.RouteOptions{UpstreamKeepAlive: time.Second})
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+			t.Fatalf("Request %d: expected the proxy to recover on a new connection, got %d %q", i+1, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestUpstreamIdleTimeout(t *testing.T) {
+	var conns atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		idle  time.Duration
+		conns int32
+	}{{0, 1}, {50 * time.Millisecond, 2}} {
+		conns.Store(0)
+		route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{UpstreamIdleTimeout: tc.idle})
+		for i := 0; i < 2; i++ {
+			route.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			time.Sleep(150 * time.Millisecond)
+		}
+		if got := conns.Load(); got != tc.conns {
+			t.Errorf("upstream_idle_timeout %s: expected %d upstream connections, got %d", tc.idle, tc.conns, got)
+		}
+	}
+}
+
+func TestForwardedHeadersModes(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		mode  string
+		want  map[string]string
+		clean bool // Whether the client sent no X-Forwarded-* headers
+	}{
+		// add replaces the client's values with its own, X-Forwarded-For holds only the bare client IP
+		{"", map[string]string{"X-Forwarded-For": "192.0.2.1", "X-Forwarded-Host": "example.com", "X-Forwarded-Proto": "http"}, false},
+		{"", map[string]string{"X-Forwarded-For": "192.0.2.1", "X-Forwarded-Host": "example.com", "X-Forwarded-Proto": "http"}, true},
+		{proxy.ForwardedPreserve, map[string]string{"X-Forwarded-For": "10.0.0.1", "X-Forwarded-Host": "client.example", "X-Forwarded-Proto": "https"}, false},
+		{proxy.ForwardedPreserve, map[string]string{"X-Forwarded-For": "", "X-Forwarded-Host": "", "X-Forwarded-Proto": ""}, true},
+		{proxy.ForwardedStrip, map[string]string{"X-Forwarded-For": "", "X-Forwarded-Host": "", "X-Forwarded-Proto": ""}, false},
+	}
+	for _, tt := range tests {
+		route := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{ForwardedHeaders: tt.mode, RetryOnStatus: []int{503}})
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		if !tt.clean {
+			req.Header.Set("X-Forwarded-For", "10.0.0.1")
+			req.Header.Set("X-Forwarded-Host", "client.example")
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+		route.Handler.ServeHTTP(httptest.NewRecorder(), req)
+		for name, want := range tt.want {
+			if value := strings.Join(got.Values(name), ", "); value != want {
+				t.Errorf("forwarded_headers %q (client headers %t): expected %s %q, got %q", tt.mode, !tt.clean, name, want, value)
+			}
+		}
+	}
+}
+
+func TestChunkedTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "part one, ")
+		w.(http.Flusher).Flush() // Chunked, the body length isn't known up front
+		io.WriteString(w, "part two")
+		w.Header().Set("X-Checksum", "abc123")
+		w.Header().Set(http.TrailerPrefix+"X-Row-Count", "2") // Undeclared trailer
+	}))
+	defer backend.Close()
+
+	for name, opts := range map[string]proxy.RouteOptions{
+		"plain":             {},
+		"buffer_response":   {BufferResponse: true},
+		"max_response_body": {MaxResponseBody: 1 << 20},
+		"header transforms": {DefaultContentType: "text/plain", DuplicateHeaders: proxy.DuplicateFirst, StreamBuffer: 4},
+	} {
+		front := httptest.NewServer(proxy.CreateRouteWithOptions(backend.URL, opts).Handler)
+		resp, err := http.Get(front.URL)
+		if err != nil {
+			front.Close()
+			t.Fatalf("%s: request failed: %v", name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		front.Close()
+		if string(body) != "part one, part two" || resp.Trailer.Get("X-Checksum") != "abc123" || resp.Trailer.Get("X-Row-Count") != "2" {
+			t.Errorf("%s: expected the body and both trailers, got %q trailer %v", name, body, resp.Trailer)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golangproxy/proxy"
+)
+
+func TestRouterUnmatchedHost(t *testing.T) {
+	landing := proxy.CreateRoute("http://127.0.0.1:8081", false)
+	catchAll := proxy.CreateRoute("http://127.0.0.1:8082", false)
+	routes := map[string]*proxy.Route{"landing.example.com": landing}
+
+	router := &proxy.Router{Routes: routes, Default: catchAll}
+	if got := router.Lookup("unknown.example.com"); got != catchAll {
+		t.Errorf("Expected '*' route for unmatched host without fallback, got %v", got)
+	}
+
+	router.FallbackHost = "landing.example.com"
+	if got := router.Lookup("unknown.example.com"); got != landing {
+		t.Errorf("Expected landing route for unmatched host with fallback, got %v", got)
+	}
+	if got := router.Lookup("landing.example.com"); got != landing {
+		t.Errorf("Expected configured host to keep its route, got %v", got)
+	}
+
+	router.FallbackHost = "missing.example.com"
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://unknown.example.com/", nil)
+	router.Lookup(req.Host).Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "not configured") {
+		t.Errorf("Expected branded 404 when fallback host has no route, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRouterRejectUnmatchedHost(t *testing.T) {
+	app := proxy.CreateRoute("http://127.0.0.1:8081", false)
+	router := &proxy.Router{Routes: map[string]*proxy.Route{"app.example.com": app}, Default: proxy.RejectRoute()}
+
+	if got := router.Lookup("app.example.com"); got != app {
+		t.Errorf("Expected configured host to keep its route, got %v", got)
+	}
+	for _, host := range []string{"unknown.example.com", "127.0.0.1", "app.example.com.evil.test"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		router.Match(req).Handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusMisdirectedRequest {
+			t.Errorf("Expected 421 for unmatched host %s in strict mode, got %d", host, rec.Code)
+		}
+	}
+}
+
+func TestRouterHeaderRoutes(t *testing.T) {
+	rest := proxy.CreateRoute("http://127.0.0.1:8080", false)
+	grpc := proxy.CreateRoute("http://127.0.0.1:50051", false)
+	router := &proxy.Router{
+		Routes:       map[string]*proxy.Route{"api.example.com": rest},
+		Default:      proxy.CreateRoute("http://127.0.0.1:61147", false),
+		HeaderRoutes: map[string][]proxy.HeaderRoute{"api.example.com": {{Header: "Accept", Value: "application/grpc", Route: grpc}}},
+	}
+
+	req := httptest.NewRequest("POST", "http://api.example.com/svc", nil)
+	req.Header.Set("Accept", "Application/GRPC+proto")
+	if got := router.Match(req); got != grpc {
+		t.Errorf("Expected gRPC backend for matching Accept header, got %s", got.Target)
+	}
+
+	req = httptest.NewRequest("GET", "http://api.example.com/svc", nil)
+	req.Header.Set("Accept", "application/json")
+	if got := router.Match(req); got != rest {
+		t.Errorf("Expected REST backend without matching header, got %s", got.Target)
+	}
+}
+
+func TestRouterLocalPaths(t *testing.T) {
+	proxied := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.Path
+	}))
+	defer backend.Close()
+	router := &proxy.Router{
+		Default: proxy.CreateRoute(backend.URL, false),
+		LocalPaths: map[string]*proxy.Route{
+			"/server-status":      proxy.LocalRoute(0, ""),
+			"/server-status/open": proxy.LocalRoute(http.StatusOK, "ok"),
+		},
+	}
+
+	for path, want := range map[string]int{
+		"/server-status":        http.StatusNotFound,
+		"/server-status/detail": http.StatusNotFound,
+		"/server-status/open":   http.StatusOK,
+		// No ServeMux cleans paths in front of the router, these must not slip past to the target
+		"/x/../server-status":      http.StatusNotFound,
+		"//server-status":          http.StatusNotFound,
+		"/server-status/./open":    http.StatusOK,
+		"/x/..%2fserver-status":    http.StatusNotFound,
+		"/server-status//open/../": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://any.example.com"+path, nil)
+		router.Match(req).Handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: expected local %d, got %d", path, want, rec.Code)
+		}
+	}
+	select {
+	case path := <-proxied:
+		t.Errorf("Expected reserved paths to stay local, %s was proxied", path)
+	default:
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://any.example.com/server-statusx", nil)
+	router.Match(req).Handler.ServeHTTP(rec, req)
+	if got := <-proxied; got != "/server-statusx" {
+		t.Errorf("Expected other paths to be proxied, got %q", got)
+	}
+}
+
+func TestRouterNormalizesHost(t *testing.T) {
+	app := proxy.CreateRoute("http://127.0.0.1:8081", false)
+	catchAll := proxy.CreateRoute("http://127.0.0.1:8082", false)
+	router := &proxy.Router{Routes: map[string]*proxy.Route{"example.com": app}, Default: catchAll}
+
+	for _, host := range []string{"Example.COM", "example.com:443", "example.com:8443", "EXAMPLE.com.:80", "example.com."} {
+		if got := router.Lookup(host); got != app {
+			t.Errorf("Expected %q to match the example.com route", host)
+		}
+	}
+	if got := router.Lookup("other.example.com"); got != catchAll {
+		t.Error("Expected other hosts to keep using the '*' route")
+	}
+}
+
+func TestRouterWildcardHostTemplate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+	wildcard := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{UpstreamHostTemplate: "{subdomain}.origin.internal"})
+	deeper := proxy.CreateRouteWithOptions(backend.URL, proxy.RouteOptions{UpstreamHostTemplate: "{host}"})
+	router := &proxy.Router{
+		Routes:  map[string]*proxy.Route{"*.example.com": wildcard, "*.eu.example.com": deeper},
+		Default: proxy.CreateRoute(backend.URL, false),
+	}
+
+	for host, want := range map[string]string{
+		"shop.example.com":      "shop.origin.internal",
+		"Blog.Example.com:8443": "blog.origin.internal",
+		"shop.eu.example.com":   "shop.eu.example.com",
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		router.Match(req).Handler.ServeHTTP(rec, req)
+		if rec.Body.String() != want {
+			t.Errorf("%s: expected upstream Host %q, got %q", host, want, rec.Body.String())
+		}
+	}
+	if router.Lookup("example.com") == wildcard {
+		t.Error("Expected the bare domain not to match its wildcard route")
+	}
+}
+
+func TestRouterRequireSNIMatch(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	router := &proxy.Router{Default: proxy.CreateRoute(backend.URL, false), RequireSNI: true}
+	front := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.Match(r).Handler.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "a.example.com"}}}
+
+	for host, want := range map[string]int{
+		"a.example.com":     http.StatusOK,
+		"A.example.com:443": http.StatusOK,
+		"b.example.com":     http.StatusMisdirectedRequest,
+	} {
+		req, _ := http.NewRequest("GET", front.URL, nil)
+		req.Host = host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Host %s over SNI a.example.com: expected %d, got %d", host, want, resp.StatusCode)
+		}
+	}
+}
+
+func TestRouterACMEWebroot(t *testing.T) {
+	webroot := t.TempDir()
+	challenges := filepath.Join(webroot, ".well-known", "acme-challenge")
+	os.MkdirAll(challenges, 0755)
+	os.WriteFile(filepath.Join(challenges, "tok-EN_123"), []byte("tok-EN_123.thumbprint"), 0644)
+	os.WriteFile(filepath.Join(webroot, "secret"), []byte("secret"), 0644)
+
+	// The '*' target is https, so without the ACME route the HTTP server would redirect
+	router := &proxy.Router{Default: proxy.CreateRoute("https://127.0.0.1:8443", false), ACME: proxy.ACMERoute(webroot)}
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/.well-known/acme-challenge/tok-EN_123", http.StatusOK, "tok-EN_123.thumbprint"},
+		{"/.well-known/acme-challenge/missing", http.StatusNotFound, ""},
+		{"/.well-known/acme-challenge/..%2F..%2Fsecret", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://any.example.com"+tt.path, nil)
+		route := router.Match(req)
+		if route.Target != "" {
+			t.Fatalf("%s: expected the proxy to answer challenges itself, got target %s", tt.path, route.Target)
+		}
+		rec := httptest.NewRecorder()
+		route.Handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status || (tt.body != "" && rec.Body.String() != tt.body) {
+			t.Errorf("%s: expected %d %q, got %d %q", tt.path, tt.status, tt.body, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestRouterMatchKind(t *testing.T) {
+	exact := proxy.CreateRoute("http://127.0.0.1:8081", false)
+	wildcard := proxy.CreateRoute("http://127.0.0.1:8082", false)
+	router := &proxy.Router{
+		Routes:     map[string]*proxy.Route{"app.example.com": exact, "*.example.com": wildcard},
+		Default:    proxy.CreateRoute("http://127.0.0.1:8083", false),
+		LocalPaths: map[string]*proxy.Route{"/healthz": proxy.LocalRoute(http.StatusOK, "ok")},
+	}
+	tests := []struct{ url, want string }{
+		{"http://app.example.com/", proxy.MatchExact},
+		{"http://app.example.com:8080/", proxy.MatchExact},
+		{"http://api.example.com/", proxy.MatchWildcard},
+		{"http://other.test/", proxy.MatchDefault},
+		{"http://app.example.com/healthz", proxy.MatchLocal},
+	}
+	for _, tt := range tests {
+		if _, got := router.MatchKind(httptest.NewRequest("GET", tt.url, nil)); got != tt.want {
+			t.Errorf("%s: expected match %s, got %s", tt.url, tt.want, got)
+		}
+	}
+}
+
+func TestRouterListenerPort(t *testing.T) {
+	production := proxy.LocalRoute(http.StatusOK, "production")
+	staging := proxy.LocalRoute(http.StatusOK, "staging")
+	router := &proxy.Router{Routes: map[string]*proxy.Route{"example.com": production}, Default: proxy.RejectRoute()}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.Match(r).Handler.ServeHTTP(w, r)
+	})
+	main := httptest.NewServer(handler)
+	defer main.Close()
+	alt := httptest.NewServer(handler)
+	defer alt.Close()
+	_, altPort, _ := net.SplitHostPort(alt.Listener.Addr().String())
+	router.Routes["example.com:"+altPort] = staging
+
+	// Both listeners get the same Host header, as behind port forwarding
+	for server, want := range map[*httptest.Server]string{main: "production", alt: "staging"} {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Host = "example.com"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.TrimSpace(string(body)) != want {
+			t.Errorf("Expected %s via %s, got %q", want, server.URL, body)
+		}
+	}
+}
+
+func TestRouterAbsoluteForm(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app " + r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+	router := &proxy.Router{
+		Routes:  map[string]*proxy.Route{"app.example.com": proxy.CreateRoute(backend.URL, false)},
+		Default: proxy.LocalRoute(http.StatusOK, "default"),
+	}
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.Match(r).Handler.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	send := func() *http.Response {
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET http://app.example.com/page?x=1 HTTP/1.1\r\nHost: other.example.com\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Reading response failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp
+	}
+
+	// The host in the request target wins over the Host header and only the path is forwarded
+	resp := send()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "app /page?x=1" {
+		t.Errorf("Expected the absolute-form request to reach app.example.com with its path, got %q", body)
+	}
+
+	router.NoAbsolute = true
+	if resp := send(); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for absolute-form requests when refused, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golangproxy/config"
+)
+
+// fakeConsul serves a KV prefix with blocking queries, like Consul's /v1/kv endpoint
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   int
+	kv      map[string]string
+	changed chan struct{}
+	waiting chan struct{} // Receives a value when a blocking query starts waiting
+}
+
+func (c *fakeConsul) set(key, value string) {
+	c.mu.Lock()
+	c.kv[key] = value
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	changed := c.changed
+	blocking := r.URL.Query().Get("index") == strconv.Itoa(c.index)
+	c.mu.Unlock()
+	if blocking {
+		select {
+		case c.waiting <- struct{}{}:
+		default:
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.Itoa(c.index))
+	fmt.Fprint(w, "[")
+	i := 0
+	for key, value := range c.kv {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		fmt.Fprintf(w, `{"Key":%q,"Value":%q}`, key, base64.StdEncoding.EncodeToString([]byte(value)))
+		i++
+	}
+	fmt.Fprint(w, "]")
+}
+
+func TestConsulRouteProvider(t *testing.T) {
+	consul := &fakeConsul{index: 1, kv: map[string]string{"proxy/routes/a.example.com": "http://10.0.0.1"}, changed: make(chan struct{}), waiting: make(chan struct{}, 1)}
+	srv := httptest.NewServer(consul)
+	defer srv.Close()
+
+	provider, err := config.NewRouteProvider(&config.Config{RouteSource: &config.RouteSource{Type: "consul", Address: srv.URL, Prefix: "proxy/routes"}}, "")
+	if err != nil {
+		t.Fatalf("Error creating route provider: %v", err)
+	}
+	routes, err := provider.LoadRoutes()
+	if err != nil {
+		t.Fatalf("Error loading routes: %v", err)
+	}
+	if routes["a.example.com"] != "http://10.0.0.1" {
+		t.Fatalf("Expected route from consul, got %v", routes)
+	}
+
+	// Change the KV once the watcher's blocking query is waiting on it
+	select {
+	case <-consul.waiting:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the watcher to start a blocking query")
+	}
+	consul.set("proxy/routes/b.example.com", "http://10.0.0.2")
+	select {
+	case <-provider.Changes():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a change notification after the KV was updated")
+	}
+	routes, _ = provider.LoadRoutes()
+	if routes["b.example.com"] != "http://10.0.0.2" {
+		t.Errorf("Expected new route after change, got %v", routes)
+	}
+}
+
+func TestFileRouteProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("routes:\n  a.example.com: http://10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	provider, err := config.NewRouteProvider(&config.Config{}, path)
+	if err != nil {
+		t.Fatalf("Error creating route provider: %v", err)
+	}
+	if provider.Changes() != nil {
+		t.Error("Expected no change channel, the config watcher reloads the file")
+	}
+	if routes, err := provider.LoadRoutes(); err != nil || routes["a.example.com"] != "http://10.0.0.1" {
+		t.Errorf("Expected the config file routes, got %v %v", routes, err)
+	}
+}
+
+func TestUnknownRouteSource(t *testing.T) {
+	if _, err := config.NewRouteProvider(&config.Config{RouteSource: &config.RouteSource{Type: "zookeeper"}}, ""); err == nil {
+		t.Error("Expected an error for an unknown route_source type")
+	}
+}
@@ -1,9 +1,36 @@
 package tests
 
 import (
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+
+	"golangproxy/server"
 )
 
 func TestStartServer(t *testing.T) {
 	// Test requires mocking or running server in a goroutine
 }
+
+func TestLandingTemplate(t *testing.T) {
+	t.Chdir(t.TempDir())
+	defer server.SetLanding("", nil)
+	render := func() string {
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Body.String()
+	}
+
+	os.WriteFile("landing.html", []byte(`<h1>{{.Version}}</h1><ul>{{range .Hosts}}<li>{{.}}</li>{{end}}</ul><p>{{.Uptime}}</p>`), 0644)
+	server.SetLanding("landing.html", []string{"b.example.com", "a.example.com"})
+	if page := render(); !strings.Contains(page, "<li>a.example.com</li><li>b.example.com</li>") {
+		t.Errorf("Expected sorted hostnames in the rendered template, got %q", page)
+	}
+
+	os.WriteFile("broken.html", []byte(`<h1>{{.Version</h1>`), 0644)
+	server.SetLanding("broken.html", nil)
+	if page := render(); !strings.Contains(page, "GoLangProxy is up") {
+		t.Errorf("Expected the built-in page for an invalid template, got %q", page)
+	}
+}
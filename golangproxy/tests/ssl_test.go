@@ -1,9 +1,23 @@
 package tests
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"golangproxy/config"
+	"golangproxy/logger"
 	"golangproxy/ssl"
 )
 
@@ -17,3 +31,208 @@ func TestEnsureCertFiles(t *testing.T) {
 		t.Error("Certificate file not created")
 	}
 }
+
+func TestRenewSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	defer func(validity time.Duration) { ssl.CertValidity = validity }(ssl.CertValidity)
+	ssl.CertValidity = time.Hour
+	if err := ssl.EnsureCertFiles(certPath, keyPath); err != nil {
+		t.Fatalf("Error generating certs: %v", err)
+	}
+	ssl.CertValidity = 365 * 24 * time.Hour
+
+	renewed, err := ssl.RenewSelfSigned(certPath, keyPath, 30*24*time.Hour)
+	if err != nil || !renewed {
+		t.Fatalf("Expected a certificate expiring in an hour to be renewed, got %t %v", renewed, err)
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Renewed certificate doesn't load: %v", err)
+	}
+	if time.Until(cert.Leaf.NotAfter) < 300*24*time.Hour || !slices.Equal(cert.Leaf.DNSNames, []string{"example.com", "localhost"}) {
+		t.Errorf("Expected a year of validity with the default SANs, got %s %v", cert.Leaf.NotAfter, cert.Leaf.DNSNames)
+	}
+
+	// Far from expiry nothing happens
+	if renewed, err := ssl.RenewSelfSigned(certPath, keyPath, 30*24*time.Hour); err != nil || renewed {
+		t.Errorf("Expected a fresh certificate to be kept, got %t %v", renewed, err)
+	}
+}
+
+func TestSelfSignedKeyType(t *testing.T) {
+	defer ssl.SetKeyType("", 0)
+	tests := []struct {
+		keyType  string
+		bits     int
+		pemType  string
+		wantBits int
+	}{
+		{"ecdsa", 0, "EC PRIVATE KEY", 256},
+		{"ECDSA", 384, "EC PRIVATE KEY", 384},
+		{"rsa", 3072, "RSA PRIVATE KEY", 3072},
+		{"ecdsa", 521, "RSA PRIVATE KEY", 2048}, // Unsupported, falls back to RSA-2048
+		{"dsa", 0, "RSA PRIVATE KEY", 2048},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		ssl.SetKeyType(tt.keyType, tt.bits)
+		if err := ssl.EnsureCertFiles(certPath, keyPath); err != nil {
+			t.Fatalf("%s %d: error generating certs: %v", tt.keyType, tt.bits, err)
+		}
+		keyPEM, _ := os.ReadFile(keyPath)
+		if block, _ := pem.Decode(keyPEM); block == nil || block.Type != tt.pemType {
+			t.Errorf("%s %d: expected a %s block", tt.keyType, tt.bits, tt.pemType)
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			t.Fatalf("%s %d: generated pair doesn't load: %v", tt.keyType, tt.bits, err)
+		}
+		var bits int
+		switch key := cert.Leaf.PublicKey.(type) {
+		case *rsa.PublicKey:
+			bits = key.N.BitLen()
+		case *ecdsa.PublicKey:
+			bits = key.Curve.Params().BitSize
+		}
+		if bits != tt.wantBits {
+			t.Errorf("%s %d: expected a %d-bit key, got %d", tt.keyType, tt.bits, tt.wantBits, bits)
+		}
+	}
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir := t.TempDir()
+	pairs := map[string]config.CertPair{}
+	for _, name := range []string{"default", "a.example.com", "*.example.com"} {
+		pair := config.CertPair{
+			CertFile: filepath.Join(dir, strings.TrimPrefix(name, "*.")+".pem"),
+			KeyFile:  filepath.Join(dir, strings.TrimPrefix(name, "*.")+".key"),
+		}
+		if err := ssl.EnsureCertFiles(pair.CertFile, pair.KeyFile); err != nil {
+			t.Fatalf("Error generating certs: %v", err)
+		}
+		pairs[name] = pair
+	}
+	def := pairs["default"]
+	delete(pairs, "default")
+
+	certs := ssl.NewCertStore()
+	if err := certs.Load(def.CertFile, def.KeyFile, pairs); err != nil {
+		t.Fatalf("Error loading certs: %v", err)
+	}
+	served := func(serverName string) string {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatalf("No certificate for %q: %v", serverName, err)
+		}
+		for name, pair := range pairs {
+			loaded, _ := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+			if bytes.Equal(cert.Certificate[0], loaded.Certificate[0]) {
+				return name
+			}
+		}
+		return "default"
+	}
+
+	tests := map[string]string{
+		"a.example.com":   "a.example.com",
+		"A.Example.COM.":  "a.example.com",
+		"b.example.com":   "*.example.com",
+		"x.b.example.com": "*.example.com",
+		"example.org":     "default",
+		"":                "default",
+	}
+	for serverName, want := range tests {
+		if got := served(serverName); got != want {
+			t.Errorf("SNI %q: expected the %s certificate, got %s", serverName, want, got)
+		}
+	}
+
+	// A cert_map entry that stops loading keeps its last good certificate
+	os.WriteFile(pairs["a.example.com"].CertFile, []byte("broken"), 0644)
+	if err := certs.Load(def.CertFile, def.KeyFile, pairs); err != nil {
+		t.Fatalf("A broken cert_map entry shouldn't fail the reload: %v", err)
+	}
+	cert, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	if wildcard, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"}); cert == wildcard {
+		t.Errorf("Expected a.example.com to keep its own certificate after a failed reload")
+	}
+}
+
+func TestHandshakeLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger.Logger.SetOutput(&buf)
+	defer logger.Logger.SetOutput(os.Stdout)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.TLSConfig = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ssl.NewHandshakeLog().Attach(server.Config)
+	server.TLS = server.Config.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+
+	// A client that only speaks TLS 1.3 fails the handshake, repeatedly
+	for i := 0; i < 15; i++ {
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+			ServerName: "app.example.com", MinVersion: tls.VersionTLS13, InsecureSkipVerify: true,
+		})
+		if err == nil {
+			conn.Close()
+			t.Fatalf("Expected the TLS 1.3 handshake to fail")
+		}
+	}
+	// A successful handshake is not logged
+	client := server.Client()
+	if resp, err := client.Get(server.URL); err == nil {
+		resp.Body.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	logged := buf.String()
+	lines := strings.Count(logged, "TLS handshake error")
+	if !strings.Contains(logged, `sni="app.example.com" offered=TLS 1.3`) || !strings.Contains(logged, "unsupported versions") {
+		t.Errorf("Expected the offered server name, versions and reason in the log, got %q", logged)
+	}
+	if lines != 10 {
+		t.Errorf("Expected handshake errors to be limited to 10 lines, got %d", lines)
+	}
+}
+
+func TestSelfSignedNamesFromRoutes(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	hosts := []string{"*", "*.apps.example.com", "Shop.Example.com", "shop.example.com:8443", "10.0.0.5", "[::1]:8443"}
+	if err := ssl.EnsureCertFiles(certPath, keyPath, hosts...); err != nil {
+		t.Fatalf("Error generating certs: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Generated pair doesn't load: %v", err)
+	}
+	leaf := cert.Leaf
+	if !slices.Equal(leaf.DNSNames, []string{"*.apps.example.com", "shop.example.com"}) {
+		t.Errorf("Expected the route hosts as DNS SANs, got %v", leaf.DNSNames)
+	}
+	if len(leaf.IPAddresses) != 2 || !leaf.IPAddresses[0].Equal(net.ParseIP("10.0.0.5")) || !leaf.IPAddresses[1].Equal(net.ParseIP("::1")) {
+		t.Errorf("Expected the IP routes as IP SANs, got %v", leaf.IPAddresses)
+	}
+	if leaf.Subject.CommonName != "shop.example.com" {
+		t.Errorf("Expected the first non-wildcard host as CommonName, got %q", leaf.Subject.CommonName)
+	}
+	if err := leaf.VerifyHostname("api.apps.example.com"); err != nil {
+		t.Errorf("Expected the wildcard SAN to cover subdomains: %v", err)
+	}
+
+	// Renewal follows the routes configured now, a host added since is covered and a removed one dropped
+	hosts = append(hosts[:len(hosts)-1], "blog.example.com")
+	if renewed, err := ssl.RenewSelfSigned(certPath, keyPath, 400*24*time.Hour, hosts...); err != nil || !renewed {
+		t.Fatalf("Expected a renewal, got %t %v", renewed, err)
+	}
+	renewed, _ := tls.LoadX509KeyPair(certPath, keyPath)
+	if !slices.Equal(renewed.Leaf.DNSNames, []string{"*.apps.example.com", "blog.example.com", "shop.example.com"}) || len(renewed.Leaf.IPAddresses) != 1 {
+		t.Errorf("Expected the renewed certificate to name the current routes, got %v %v", renewed.Leaf.DNSNames, renewed.Leaf.IPAddresses)
+	}
+}